@@ -5,10 +5,14 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"github.com/vugu/vgrun/autoreload"
 )
 
 func newAutoReloader() *autoReloader {
@@ -16,6 +20,7 @@ func newAutoReloader() *autoReloader {
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool { return true },
 		},
+		sources: &sourceResolver{},
 	}
 }
 
@@ -24,41 +29,208 @@ type autoReloader struct {
 	upgrader websocket.Upgrader
 
 	rwmu  sync.RWMutex
-	clist []*websocket.Conn
+	clist []*arConn
+	pid   int // guarded by rwmu too, so new conns don't miss a change
+
+	lastBuild func() *buildReport // result of the most recent build, sent to browsers as they connect
+
+	logRate int // lines of process output per second each browser may be sent
 
-	pid int
+	browserConsole string // browser console output printed here: "all", "errors" or "off"
+
+	sources *sourceResolver // for the stack traces of wasm panics
 }
 
-func (ar *autoReloader) setPid(pid int) {
-	ar.pid = pid
-	// send out to browser on a slight delay
+// arConn is a connected browser.  Messages are queued and written by a
+// single goroutine, the websocket package does not allow concurrent writers
+// and this also keeps them in order.
+type arConn struct {
+	c      *websocket.Conn
+	sendCh chan json.RawMessage // a nil message closes the connection
+	done   chan struct{}        // closed when writeLoop returns
+
+	logMu     sync.Mutex
+	logs      bool      // the browser asked for process output
+	logTokens float64   // lines which can be sent now, refilled at the rate limit
+	logLast   time.Time // when logTokens was last refilled
+	dropped   int       // lines not sent since the last one which was
+	closed    bool      // sendCh is closed
+}
+
+// send queues msg without blocking, it is dropped if the browser is too far behind.
+func (ac *arConn) send(msg json.RawMessage) {
+	select {
+	case ac.sendCh <- msg:
+	default:
+		if *flagV {
+			log.Printf("Dropping message to slow client (%v): %s", ac.c.RemoteAddr(), msg)
+		}
+	}
+}
+
+// sendLog queues a line of process output if the browser asked for it and
+// it's within rate lines per second (with bursts up to a second's worth).
+// Lines over the limit are dropped and counted, the browser is told how
+// many before the next line which isn't, or after a second.
+func (ac *arConn) sendLog(msg json.RawMessage, rate int) {
+	ac.logMu.Lock()
+	defer ac.logMu.Unlock()
+	if !ac.logs {
+		return
+	}
+	now := time.Now()
+	ac.logTokens += now.Sub(ac.logLast).Seconds() * float64(rate)
+	if ac.logTokens > float64(rate) {
+		ac.logTokens = float64(rate)
+	}
+	ac.logLast = now
+	if ac.logTokens < 1 {
+		ac.dropped++
+		if ac.dropped == 1 {
+			time.AfterFunc(time.Second, func() {
+				ac.logMu.Lock()
+				defer ac.logMu.Unlock()
+				ac.sendDropped()
+			})
+		}
+		return
+	}
+	ac.logTokens--
+	ac.sendDropped()
+	ac.send(msg)
+}
+
+// sendDropped tells the browser how many lines were dropped, if any.  logMu must be held.
+func (ac *arConn) sendDropped() {
+	if ac.dropped > 0 && !ac.closed {
+		ac.send(mustMarshal(autoreload.LogDropped{Count: ac.dropped}))
+	}
+	ac.dropped = 0
+}
+
+// setLogs turns process output for the browser on or off.
+func (ac *arConn) setLogs(on bool, rate int) {
+	ac.logMu.Lock()
+	defer ac.logMu.Unlock()
+	ac.logs = on
+	ac.logTokens = float64(rate)
+	ac.logLast = time.Now()
+	ac.dropped = 0
+}
+
+// writeLoop writes queued messages until the queue is closed, a write fails
+// or a nil message asks for the connection to be closed.
+func (ac *arConn) writeLoop() {
+	defer close(ac.done)
+	for msg := range ac.sendCh {
+		if msg == nil {
+			ac.c.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "vgrun stopped"),
+				time.Now().Add(time.Second))
+			break
+		}
+		err := ac.c.WriteJSON(msg)
+		if err != nil {
+			if *flagV {
+				log.Printf("Error sending message to (%v): %v", ac.c.RemoteAddr(), err)
+			}
+			break
+		}
+	}
+	ac.c.Close() // unblocks the read loop, which cleans up
+	// drain the queue until serveWS closes it
 	go func() {
-		time.Sleep(time.Millisecond * 200)
-		ar.push([]byte(fmt.Sprintf(`{"type":"exec","pid":%d}`, pid)))
+		for range ac.sendCh {
+		}
 	}()
 }
 
-func (ar *autoReloader) push(jsonMessage []byte) {
-	if *flagV {
-		log.Printf("autoReloader pushing message: %s", jsonMessage)
+// setPid is called once a new process is ready, browsers reload when the pid changes.
+func (ar *autoReloader) setPid(pid int) {
+	ar.rwmu.Lock()
+	ar.pid = pid
+	ar.rwmu.Unlock()
+	ar.push(autoreload.ProcessReady{Pid: pid})
+}
+
+// reload tells browsers to reload without a new process having started,
+// e.g. after only the wasm client was rebuilt.
+func (ar *autoReloader) reload() {
+	ar.push(autoreload.Reload{})
+}
+
+// reloadCSS tells browsers to swap the stylesheets for the changed css files, without a reload.
+func (ar *autoReloader) reloadCSS(paths []string) {
+	names := make([]string, 0, len(paths))
+	for _, p := range paths {
+		names = append(names, filepath.Base(p))
 	}
+	ar.push(autoreload.CSSUpdate{Names: names})
+}
+
+// buildStart tells browsers a build has started.
+func (ar *autoReloader) buildStart(targets []string) {
+	ar.push(autoreload.BuildStart{Time: time.Now(), Targets: targets})
+}
+
+// buildReport sends the result of a build, including any diagnostics, to browsers.
+func (ar *autoReloader) buildReport(br *buildReport) {
+	ar.push(br)
+}
+
+// logLine sends a line of process output to the browsers which asked for it.
+func (ar *autoReloader) logLine(l logLine) {
+	b := mustMarshal(l)
 
 	ar.rwmu.RLock()
-	clist := make([]*websocket.Conn, len(ar.clist))
-	copy(clist, ar.clist)
+	defer ar.rwmu.RUnlock()
+	for _, ac := range ar.clist {
+		ac.sendLog(b, ar.logRate)
+	}
+}
+
+// shutdown tells browsers vgrun is going away and disconnects them, waiting
+// up to timeout for the messages to go out.
+func (ar *autoReloader) shutdown(timeout time.Duration) {
+	ar.push(autoreload.Shutdown{})
+
+	ar.rwmu.RLock()
+	clist := append([]*arConn(nil), ar.clist...)
+	for _, ac := range clist {
+		ac.send(nil) // the end, see writeLoop
+	}
 	ar.rwmu.RUnlock()
 
-	rawmsg := json.RawMessage(jsonMessage)
-	for _, c := range clist {
-		c := c
-		go func() {
-			err := c.WriteJSON(rawmsg)
-			if err != nil {
-				if *flagV {
-					log.Printf("Error sending message to (%v): %v", c, err)
-				}
-			}
-		}()
+	deadline := time.After(timeout)
+	for _, ac := range clist {
+		select {
+		case <-ac.done:
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// mustMarshal returns the JSON for m, which can't fail for the message types.
+func mustMarshal(m autoreload.Message) json.RawMessage {
+	b, err := autoreload.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func (ar *autoReloader) push(m autoreload.Message) {
+	rawmsg := mustMarshal(m)
+	if *flagV {
+		log.Printf("autoReloader pushing message: %s", rawmsg)
+	}
+
+	ar.rwmu.RLock()
+	defer ar.rwmu.RUnlock()
+
+	for _, ac := range ar.clist {
+		ac.send(rawmsg)
 	}
 
 }
@@ -83,17 +255,305 @@ func (ar *autoReloader) serveJS(w http.ResponseWriter, r *http.Request) {
 (function() {
 
 	var pid = 0;
+	var sock = null;
+
+	// console output and uncaught errors are forwarded to vgrun, which prints
+	// them in the terminal; con is the original console, for our own messages
+	var forward = "`+ar.browserConsole+`";
+	var con = {};
+	["log", "info", "warn", "error", "debug"].forEach(function(k) { con[k] = console[k].bind(console); });
+	var tab = "";
+	try {
+		tab = sessionStorage.getItem("vgrun-tab") || Math.random().toString(36).slice(2, 6);
+		sessionStorage.setItem("vgrun-tab", tab);
+	} catch (e) {}
+	var outbox = []; // sent once the socket is open
+	var sendMsg = function(m) {
+		m.url = window.location.href;
+		m.tab = tab;
+		var msg = JSON.stringify(m);
+		if (sock && sock.readyState == 1) {
+			sock.send(msg);
+		} else if (outbox.length < 100) {
+			outbox.push(msg);
+		}
+	};
+	var muted = 0; // set while the trace of a wasm panic is written, it's sent on exit
+	var forwardMsg = function(level, text) {
+		if (!muted) {
+			sendMsg({type: "console", level: level, text: text.slice(0, 8192)});
+		}
+	};
+	var format = function(args) {
+		return Array.prototype.map.call(args, function(a) {
+			if (a instanceof Error) {
+				return a.stack || String(a);
+			}
+			if (a && typeof a == "object") {
+				try { return JSON.stringify(a); } catch (e) {}
+			}
+			return String(a);
+		}).join(" ");
+	};
+	if (forward == "all" || forward == "errors") {
+		(forward == "all" ? ["log", "info", "warn", "error", "debug"] : ["error"]).forEach(function(k) {
+			console[k] = function() {
+				con[k].apply(console, arguments);
+				forwardMsg(k, format(arguments));
+			};
+		});
+		window.addEventListener("error", function(e) {
+			forwardMsg("error", "Uncaught " + (e.error && e.error.stack ? e.error.stack :
+				e.message + " (" + e.filename + ":" + e.lineno + ":" + e.colno + ")"));
+		});
+		window.addEventListener("unhandledrejection", function(e) {
+			forwardMsg("error", "Unhandled rejection: " + format([e.reason]));
+		});
+	}
+
+	// a Go wasm program which panics writes the trace to fd 2 and exits, the
+	// Go class from wasm_exec.js is hooked (whether it's loaded before or after
+	// us) to catch that and send the trace, which comes back with local paths
+	var wasmErr = "";
+	var panicking = false;
+	var hookFS = function() {
+		var fs = globalThis.fs;
+		if (!fs || fs.writeSync.vgrun) {
+			return;
+		}
+		var decoder = new TextDecoder("utf-8");
+		var writeSync = fs.writeSync;
+		fs.writeSync = function(fd, buf) {
+			var quiet = false;
+			if (fd == 2) {
+				wasmErr = (wasmErr + decoder.decode(buf)).slice(-65536);
+				panicking = panicking || /^(panic|fatal error): /m.test(wasmErr);
+				quiet = panicking;
+			}
+			if (quiet) {
+				muted++;
+			}
+			try {
+				return writeSync.apply(this, arguments);
+			} finally {
+				if (quiet) {
+					muted--;
+				}
+			}
+		};
+		fs.writeSync.vgrun = true;
+	};
+	var hookGo = function(Go) {
+		if (!Go || !Go.prototype || Go.prototype.run.vgrun) {
+			return Go;
+		}
+		var run = Go.prototype.run;
+		Go.prototype.run = function() {
+			var exit = this.exit;
+			this.exit = function(code) {
+				var i = wasmErr.search(/^(panic|fatal error): /m);
+				if (code !== 0 && i >= 0) {
+					sendMsg({type: "wasm-panic", code: code, text: wasmErr.slice(i)});
+				}
+				return exit.apply(this, arguments);
+			};
+			wasmErr = "";
+			panicking = false;
+			hookFS();
+			return run.apply(this, arguments);
+		};
+		Go.prototype.run.vgrun = true;
+		return Go;
+	};
+	if (globalThis.Go) {
+		hookGo(globalThis.Go);
+	} else {
+		var goClass;
+		Object.defineProperty(globalThis, "Go", {
+			configurable: true,
+			enumerable: true,
+			get: function() { return goClass; },
+			set: function(v) { goClass = hookGo(v); }
+		});
+	}
 
-	console.log("vgrun auto-reload.js starting...");
+	con.log("vgrun auto-reload.js starting...");
+
+	// output of the processes is echoed to the console if turned on in this
+	// tab with vgrunLogs(), it stays on across reloads
+	var logsOn = false;
+	try { logsOn = sessionStorage.getItem("vgrun-logs") == "1"; } catch (e) {}
+	var sendLogs = function() {
+		if (sock && sock.readyState == 1) {
+			sock.send(JSON.stringify({type: "logs", enabled: logsOn}));
+		}
+	};
+	window.vgrunLogs = function(on) {
+		logsOn = on !== false;
+		try { sessionStorage.setItem("vgrun-logs", logsOn ? "1" : "0"); } catch (e) {}
+		sendLogs();
+		con.log("vgrun: process output " + (logsOn ? "on" : "off") + " in this tab");
+	};
+	if (!logsOn) {
+		con.log("vgrun: run vgrunLogs() to see the output of the processes in this console");
+	}
+
+	// overlay listing the problems from a failed build, until the next build
+	// succeeds or it's dismissed
+	var overlay = null;
+
+	var hideOverlay = function() {
+		if (overlay) {
+			overlay.remove();
+			overlay = null;
+		}
+	};
+
+	var showOverlay = function(data) {
+		hideOverlay();
+
+		overlay = document.createElement("div");
+		overlay.id = "vgrun-build-overlay";
+		overlay.setAttribute("style", "position:fixed;top:0;left:0;right:0;bottom:0;z-index:2147483647;"+
+			"overflow:auto;background:rgba(20,20,20,0.92);color:#eee;padding:24px 32px;"+
+			"font:13px/1.5 Menlo,Consolas,monospace;white-space:pre-wrap;");
+
+		var close = document.createElement("button");
+		close.textContent = "\u00d7";
+		close.title = "Dismiss (Esc)";
+		close.setAttribute("style", "position:absolute;top:12px;right:16px;font-size:24px;background:none;"+
+			"border:none;color:#eee;cursor:pointer;");
+		close.onclick = hideOverlay;
+		overlay.appendChild(close);
+
+		var title = document.createElement("div");
+		var what = "Build failed";
+		if ((data.stages || []).some(function(s) { return s.name == "ready" && s.status == "failed"; })) {
+			what = "Ready check failed";
+		}
+		title.textContent = data.title || what + (data.targets && data.targets.length ? " (" + data.targets.join(", ") + ")" : "");
+		title.setAttribute("style", "font-size:18px;color:#ff6b6b;margin-bottom:16px;");
+		overlay.appendChild(title);
+
+		var diags = data.diagnostics || [];
+		diags.forEach(function(d) {
+			var row = document.createElement("div");
+			row.setAttribute("style", "margin-bottom:8px;");
+			var pos = document.createElement("span");
+			pos.textContent = d.file + ":" + d.line + (d.column ? ":" + d.column : "");
+			pos.setAttribute("style", "color:#8ab4f8;");
+			var stage = document.createElement("span");
+			stage.textContent = " [" + (d.target ? d.target + " " : "") + d.stage + "] ";
+			stage.setAttribute("style", "color:#999;");
+			var msg = document.createElement("span");
+			msg.textContent = d.message;
+			row.appendChild(pos);
+			row.appendChild(stage);
+			row.appendChild(msg);
+			overlay.appendChild(row);
+		});
+		if (!diags.length) { // nothing parsed, show the raw errors
+			var raw = document.createElement("div");
+			raw.textContent = (data.errors || []).join("\n");
+			overlay.appendChild(raw);
+		}
+
+		document.body.appendChild(overlay);
+	};
+
+	// banner shown while vgrun is stopped
+	var showStopped = function() {
+		if (document.getElementById("vgrun-stopped")) {
+			return;
+		}
+		var banner = document.createElement("div");
+		banner.id = "vgrun-stopped";
+		banner.textContent = "vgrun stopped, waiting for it to start again";
+		banner.setAttribute("style", "position:fixed;bottom:12px;right:12px;z-index:2147483647;padding:6px 12px;"+
+			"background:rgba(20,20,20,0.85);color:#eee;font:12px/1.5 Menlo,Consolas,monospace;border-radius:4px;");
+		document.body.appendChild(banner);
+	};
+
+	document.addEventListener("keydown", function(e) {
+		if (e.key == "Escape") {
+			hideOverlay();
+		}
+	});
 
 	var connect;
 	connect = function() {
 
-		var sock = new WebSocket("ws://`+r.Host+`/listen");
+		sock = new WebSocket("ws://`+r.Host+`/listen");
+
+		sock.onopen = function() {
+			sock.send(JSON.stringify({type: "hello", version: `+strconv.Itoa(autoreload.Version)+`}));
+			if (logsOn) {
+				sendLogs();
+			}
+			outbox.forEach(function(msg) { sock.send(msg); });
+			outbox = [];
+		};
 
 		sock.onmessage = function(event) {
 			//console.log("auto-reload received message:", event);
 			var data = JSON.parse(event.data);
+			if (data.type == "log") {
+				(data.stream == "stderr" ? con.error : con.log)("%c[vgrun " + data.target + "]", "color:#888", data.text);
+				return;
+			}
+			if (data.type == "log-dropped") {
+				con.warn("[vgrun] " + data.count + " lines of output dropped, over the rate limit");
+				return;
+			}
+			if (data.type == "build-result") {
+				if (data.success) {
+					hideOverlay();
+				} else {
+					showOverlay(data);
+				}
+				return;
+			}
+			if (data.type == "wasm-panic") {
+				showOverlay({title: "Go panic (wasm)", errors: [data.text]});
+				return;
+			}
+			if (data.type == "shutdown") { // vgrun is exiting, we reload once it's back with a new process
+				con.log("auto-reload: vgrun stopped");
+				showStopped();
+				return;
+			}
+			if (data.type == "reload") { // rebuilt without a process restart, e.g. wasm client
+				con.log("auto-reload initiated for rebuild");
+				window.location.reload();
+				return;
+			}
+			if (data.type == "error") {
+				con.error("[vgrun] " + data.message);
+				return;
+			}
+			if (data.type == "css-update") { // swap matching stylesheets, or all of them if none match
+				var links = document.querySelectorAll("link[rel=stylesheet]");
+				var matched = [];
+				links.forEach(function(link) {
+					var name = new URL(link.href, window.location.href).pathname.split("/").pop();
+					if (data.names.indexOf(name) >= 0) {
+						matched.push(link);
+					}
+				});
+				if (!matched.length) {
+					matched = links;
+				}
+				matched.forEach(function(link) {
+					var u = new URL(link.href, window.location.href);
+					u.searchParams.set("vgrun", Date.now());
+					link.href = u.toString();
+				});
+				con.log("auto-reload updated stylesheets for", data.names);
+				return;
+			}
+			if (data.type != "hello" && data.type != "process-ready") { // e.g. build-start, or newer types
+				return;
+			}
 			if (!pid) { // first value for pid
 				pid = data.pid;
 				return;
@@ -106,30 +566,20 @@ func (ar *autoReloader) serveJS(w http.ResponseWriter, r *http.Request) {
 			}
 			// must be different pid
 			pid = data.pid;
-			console.log("auto-reload initiated for for pid ", pid)
-			// check that the server is alive again before reloading
-			// TODO: clean this up
-			setInterval(function() {
-				fetch("//`+r.Host+`/auto-reload.js",{mode:'no-cors'}).then(function(r) {
-					// if the server is down we don't get a response at all
-					// and this function is never invoked, so getting here should be good
-					//console.log("resback:", r);
-					//if (r.ok) {
-						window.location.reload();
-					//}
-				});
-			}, 750)
+			// vgrun only sends this once the new process passed its ready check
+			con.log("auto-reload initiated for for pid ", pid)
+			window.location.reload();
 		}
 
 		sock.onclose = function(e) {
-			console.log('auto-reload socket closed, reconnecting in 2 seconds, reason:', e.reason);
+			con.log('auto-reload socket closed, reconnecting in 2 seconds, reason:', e.reason);
 			setTimeout(function() {
 				connect();
 			}, 2000);
 		};
 		
 		sock.onerror = function(err) {
-			console.log('auto-reload socket error, closing, message:', err.message);
+			con.log('auto-reload socket error, closing, message:', err.message);
 			sock.close();
 		};
 	  
@@ -152,14 +602,26 @@ func (ar *autoReloader) serveWS(w http.ResponseWriter, r *http.Request) {
 	}
 	defer c.Close()
 
+	ac := &arConn{c: c, sendCh: make(chan json.RawMessage, 64), done: make(chan struct{})}
+	go ac.writeLoop()
+
+	// upon first connect we send them the protocol version and current pid,
+	// and how the last build went; these are queued along with adding the
+	// conn to clist so they go out first, and a new pid can't slip between
 	ar.rwmu.Lock()
-	ar.clist = append(ar.clist, c)
+	ac.send(mustMarshal(autoreload.Hello{Version: autoreload.Version, MinVersion: autoreload.MinVersion, Pid: ar.pid}))
+	if ar.lastBuild != nil {
+		if br := ar.lastBuild(); br != nil {
+			ac.send(mustMarshal(br))
+		}
+	}
+	ar.clist = append(ar.clist, ac)
 	ar.rwmu.Unlock()
 
 	defer func() {
 		ar.rwmu.Lock()
 		for i, cl := range ar.clist {
-			if cl == c { // remove clist[i]
+			if cl == ac { // remove clist[i]
 				s := ar.clist
 				s[len(s)-1], s[i] = s[i], s[len(s)-1]
 				s = s[:len(s)-1]
@@ -168,28 +630,51 @@ func (ar *autoReloader) serveWS(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		ar.rwmu.Unlock()
+		ac.logMu.Lock()
+		ac.closed = true
+		ac.logMu.Unlock()
+		close(ac.sendCh) // nothing can push to it now
 	}()
 
-	// upon first connect we send them the current pid
-
-	rawmsg := json.RawMessage(fmt.Sprintf(`{"type":"last_exec","pid":%d}`, ar.pid))
-	err = c.WriteJSON(rawmsg)
-	if err != nil {
-		log.Println("WriteJSON error:", err)
-		return
-	}
-
-	// just read messages indefinitely until error (client disconnects)
+	// read messages until error (client disconnects): its hello, console
+	// output and wasm panics from the browser, or turning process output on
+	// or off
 	for {
 
-		mt, message, err := c.ReadMessage()
+		_, message, err := c.ReadMessage()
 		if err != nil {
 			if *flagV {
 				log.Println("read error:", err)
 			}
 			break
 		}
-		_, _ = mt, message
+
+		m, err := autoreload.Unmarshal(message)
+		if err != nil {
+			m = nil
+		}
+		switch m := m.(type) {
+		case autoreload.Hello:
+			if m.Version < autoreload.MinVersion {
+				ac.send(mustMarshal(autoreload.Error{Message: fmt.Sprintf("protocol version %d is not supported, the oldest is %d", m.Version, autoreload.MinVersion)}))
+				ac.send(nil)
+			}
+		case autoreload.Logs:
+			ac.setLogs(m.Enabled, ar.logRate)
+		case autoreload.Console:
+			if ar.browserConsole != "off" {
+				log.Printf("[browser %s %s] %s: %s", m.Tab, m.URL, m.Level, m.Text)
+			}
+		case autoreload.WasmPanic:
+			// the trace goes back to the browser too, for the overlay
+			text := ar.sources.symbolize(m.Text)
+			log.Printf("[browser %s %s] wasm exited with code %d:\n%s", m.Tab, m.URL, m.Code, text)
+			ac.send(mustMarshal(autoreload.WasmPanic{Text: text}))
+		default:
+			if *flagV {
+				log.Printf("Ignoring message from (%v): %s", c.RemoteAddr(), message)
+			}
+		}
 
 	}
 
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vugu/vgrun/autoreload"
+)
+
+func TestAutoReloaderHello(t *testing.T) {
+
+	ar := newAutoReloader()
+	srv := httptest.NewServer(ar)
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// new processes start while browsers connect
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for pid := 1; pid <= 20; pid++ {
+			ar.setPid(pid)
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		c, err := autoreload.Dial(ctx, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	<-done
+
+	c, err := autoreload.Dial(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if h := c.Hello(); h.Version != autoreload.Version || h.Pid != 20 {
+		t.Errorf("unexpected hello %+v", h)
+	}
+
+	ar.setPid(21)
+	m, err := c.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr, ok := m.(autoreload.ProcessReady); !ok || pr.Pid != 21 {
+		t.Errorf("unexpected message %#v", m)
+	}
+}
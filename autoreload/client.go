@@ -0,0 +1,99 @@
+package autoreload
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Client is a connection to the auto-reload server.  Next must only be
+// called from one goroutine at a time, Send can be called from any.
+type Client struct {
+	conn  *websocket.Conn
+	hello Hello
+
+	mu sync.Mutex // serializes writes
+}
+
+// Dial connects to the auto-reload server at addr, either a host:port (as
+// given to vgrun with -auto-reload-at) or a ws:// URL, and exchanges Hellos
+// with it.  An error is returned if the server doesn't speak this version of
+// the protocol.
+func Dial(ctx context.Context, addr string) (*Client, error) {
+
+	u := addr
+	if !strings.Contains(u, "://") {
+		u = "ws://" + addr + "/listen"
+	}
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn}
+
+	m, err := c.Next()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	hello, ok := m.(Hello)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("expected %s message, got %s", TypeHello, m.MessageType())
+	}
+	if hello.MinVersion > Version || hello.Version < MinVersion {
+		conn.Close()
+		return nil, fmt.Errorf("server speaks protocol versions %d to %d, this client %d", hello.MinVersion, hello.Version, Version)
+	}
+	c.hello = hello
+
+	err = c.Send(Hello{Version: Version})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Hello returns the Hello the server sent when the client connected.
+func (c *Client) Hello() Hello {
+	return c.hello
+}
+
+// Next waits for the next message from the server.  Messages of types this
+// package doesn't know are returned as Unknown.
+func (c *Client) Next() (Message, error) {
+	_, b, err := c.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	return Unmarshal(b)
+}
+
+// Send sends m to the server.
+func (c *Client) Send(m Message) error {
+	b, err := Marshal(m)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, b)
+}
+
+// SetLogs turns Log messages, the output of the processes, on or off.
+func (c *Client) SetLogs(on bool) error {
+	return c.Send(Logs{Enabled: on})
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.mu.Unlock()
+	return c.conn.Close()
+}
@@ -0,0 +1,243 @@
+// Package autoreload describes the messages sent over the websocket of the
+// vgrun auto-reload server (at /listen), and has a client for tools which
+// want to follow what vgrun is doing.
+//
+// Every message is a JSON object with a "type" field.  The server starts each
+// connection with a Hello carrying the protocol version.  A client may reply
+// with a Hello of its own; if its version is older than MinVersion the server
+// sends an Error and closes the connection.  Messages of types a client
+// doesn't know should be ignored, newer servers may add them without
+// changing the version.
+package autoreload
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// Version is the version of the protocol described here.
+const Version = 1
+
+// MinVersion is the oldest version of the protocol the server still speaks.
+const MinVersion = 1
+
+// Message types, the value of the "type" field.
+const (
+	TypeHello        = "hello"
+	TypeError        = "error"
+	TypeBuildStart   = "build-start"
+	TypeBuildResult  = "build-result"
+	TypeProcessReady = "process-ready"
+	TypeReload       = "reload"
+	TypeCSSUpdate    = "css-update"
+	TypeLog          = "log"
+	TypeLogDropped   = "log-dropped"
+	TypeShutdown     = "shutdown"
+	TypeWasmPanic    = "wasm-panic"
+	TypeLogs         = "logs"
+	TypeConsole      = "console"
+)
+
+// Message is one of the message types below.
+type Message interface {
+	MessageType() string
+}
+
+// Hello is the first message the server sends on each connection.  Clients
+// may send one too, with their own Version.
+type Hello struct {
+	Version    int `json:"version"`
+	MinVersion int `json:"min-version,omitempty"` // server only
+	Pid        int `json:"pid"`                   // server only, the current process, 0 if none
+}
+
+// Error is sent by the server before it closes a connection it can't serve.
+type Error struct {
+	Message string `json:"message"`
+}
+
+// BuildStart is sent when a build starts.
+type BuildStart struct {
+	Time    time.Time `json:"time"`
+	Targets []string  `json:"targets"` // targets being built, empty when only pipeline stages run
+}
+
+// BuildResult is the outcome of one generate and build cycle.  It's sent
+// once the build is done, and to each client as it connects.
+type BuildResult struct {
+	Time        time.Time     `json:"time"`
+	Success     bool          `json:"success"`
+	Targets     []string      `json:"targets"`               // targets which were built
+	Stages      []StageResult `json:"stages,omitempty"`      // pipeline stages which ran, in order
+	Diagnostics []Diagnostic  `json:"diagnostics,omitempty"` // parsed problems, if any
+	Errors      []string      `json:"errors,omitempty"`      // full error text for each failure
+}
+
+// StageResult is how a pipeline stage went in one build.  A failed stage
+// named "ready" means the build was fine but the new processes failed their
+// ready checks.
+type StageResult struct {
+	Name     string  `json:"name"`
+	Status   string  `json:"status"`          // "ok", "failed" or "skipped" (a dependency failed)
+	Duration float64 `json:"duration"`        // seconds
+	Error    string  `json:"error,omitempty"` // for failed stages
+}
+
+// Diagnostic is a single problem reported by go generate (including
+// vugugen), go build or vet, pointing at a location in a source file.
+type Diagnostic struct {
+	Stage   string `json:"stage"`            // "generate", "vugugen", "build", "vet" or the name of a pipeline stage
+	Target  string `json:"target,omitempty"` // target being built, empty for generate
+	File    string `json:"file"`             // relative to the dir vgrun runs in where possible
+	Line    int    `json:"line"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+func (d Diagnostic) String() string {
+	pos := d.File + ":" + strconv.Itoa(d.Line)
+	if d.Column > 0 {
+		pos += ":" + strconv.Itoa(d.Column)
+	}
+	return pos + ": " + d.Message
+}
+
+// ProcessReady is sent when a new process has started and passed its
+// ready check, browsers reload when Pid changes.
+type ProcessReady struct {
+	Pid int `json:"pid"`
+}
+
+// Reload asks browsers to reload without a new process having started,
+// e.g. after only the wasm client was rebuilt.
+type Reload struct{}
+
+// CSSUpdate asks browsers to reload the stylesheets with these file names,
+// without reloading the page.
+type CSSUpdate struct {
+	Names []string `json:"names"`
+}
+
+// Log is a line of output from a process.  It's only sent to clients which
+// asked for them with Logs.
+type Log struct {
+	Time   time.Time `json:"time"`
+	Target string    `json:"target"`
+	Build  int       `json:"build"`  // which build of the target wrote it, counting from 1
+	Stream string    `json:"stream"` // "stdout" or "stderr"
+	Text   string    `json:"text"`
+}
+
+// LogDropped is sent when lines were left out to keep within the rate limit.
+type LogDropped struct {
+	Count int `json:"count"`
+}
+
+// Shutdown is sent when vgrun is exiting, the connection closes after it.
+type Shutdown struct{}
+
+// WasmPanic is sent by a browser when a Go wasm program exits after a panic,
+// the server sends it back with the file paths in Text made local.
+type WasmPanic struct {
+	Code int    `json:"code,omitempty"` // exit code
+	Text string `json:"text"`           // the panic message and stack trace
+	URL  string `json:"url,omitempty"`
+	Tab  string `json:"tab,omitempty"`
+}
+
+// Logs is sent by a client to turn Log messages on or off.
+type Logs struct {
+	Enabled bool `json:"enabled"`
+}
+
+// Console is sent by a browser for console output or an uncaught error.
+type Console struct {
+	Level string `json:"level"` // e.g. "log" or "error"
+	Text  string `json:"text"`
+	URL   string `json:"url"`
+	Tab   string `json:"tab"` // identifies the tab, it stays the same across reloads
+}
+
+// Unknown is a message of a type this package doesn't know.
+type Unknown struct {
+	Type string
+	Raw  json.RawMessage
+}
+
+func (Hello) MessageType() string        { return TypeHello }
+func (Error) MessageType() string        { return TypeError }
+func (BuildStart) MessageType() string   { return TypeBuildStart }
+func (BuildResult) MessageType() string  { return TypeBuildResult }
+func (ProcessReady) MessageType() string { return TypeProcessReady }
+func (Reload) MessageType() string       { return TypeReload }
+func (CSSUpdate) MessageType() string    { return TypeCSSUpdate }
+func (Log) MessageType() string          { return TypeLog }
+func (LogDropped) MessageType() string   { return TypeLogDropped }
+func (Shutdown) MessageType() string     { return TypeShutdown }
+func (WasmPanic) MessageType() string    { return TypeWasmPanic }
+func (Logs) MessageType() string         { return TypeLogs }
+func (Console) MessageType() string      { return TypeConsole }
+func (u Unknown) MessageType() string    { return u.Type }
+
+// Marshal returns the JSON for m, with its type.
+func Marshal(m Message) ([]byte, error) {
+	if u, ok := m.(Unknown); ok {
+		return u.Raw, nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 2 || b[0] != '{' {
+		return nil, fmt.Errorf("message %T is not a JSON object", m)
+	}
+	ret := []byte(`{"type":` + strconv.Quote(m.MessageType()))
+	if len(b) > 2 {
+		ret = append(ret, ',')
+	}
+	return append(ret, b[1:]...), nil
+}
+
+// messageTypes has the zero value of each message type, by type.
+var messageTypes = map[string]Message{
+	TypeHello:        Hello{},
+	TypeError:        Error{},
+	TypeBuildStart:   BuildStart{},
+	TypeBuildResult:  BuildResult{},
+	TypeProcessReady: ProcessReady{},
+	TypeReload:       Reload{},
+	TypeCSSUpdate:    CSSUpdate{},
+	TypeLog:          Log{},
+	TypeLogDropped:   LogDropped{},
+	TypeShutdown:     Shutdown{},
+	TypeWasmPanic:    WasmPanic{},
+	TypeLogs:         Logs{},
+	TypeConsole:      Console{},
+}
+
+// Unmarshal decodes a message, returning one of the message types (not a
+// pointer to it).  Messages of unknown types are returned as Unknown.
+func Unmarshal(b []byte) (Message, error) {
+
+	var t struct {
+		Type string `json:"type"`
+	}
+	err := json.Unmarshal(b, &t)
+	if err != nil {
+		return nil, err
+	}
+
+	zero, ok := messageTypes[t.Type]
+	if !ok {
+		return Unknown{Type: t.Type, Raw: append(json.RawMessage(nil), b...)}, nil
+	}
+	p := reflect.New(reflect.TypeOf(zero))
+	err = json.Unmarshal(b, p.Interface())
+	if err != nil {
+		return nil, fmt.Errorf("%s message: %w", t.Type, err)
+	}
+	return p.Elem().Interface().(Message), nil
+}
@@ -0,0 +1,54 @@
+package autoreload
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMarshalUnmarshal(t *testing.T) {
+
+	for _, m := range []Message{
+		Hello{Version: Version, MinVersion: MinVersion, Pid: 123},
+		BuildResult{Success: false, Targets: []string{"server"}, Diagnostics: []Diagnostic{{Stage: "build", File: "main.go", Line: 3, Message: "undefined: x"}}},
+		Reload{},
+		CSSUpdate{Names: []string{"app.css"}},
+		Console{Level: "error", Text: "boom", URL: "http://localhost/", Tab: "t1"},
+	} {
+		b, err := Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(b), `{"type":"`+m.MessageType()+`"`) {
+			t.Errorf("unexpected JSON %s", b)
+		}
+		m2, err := Unmarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m, m2) {
+			t.Errorf("round trip of %s: got %#v, want %#v", b, m2, m)
+		}
+	}
+
+	b, err := Marshal(Reload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"type":"reload"}` {
+		t.Errorf("unexpected JSON %s", b)
+	}
+
+	// newer servers may send types we don't know
+	m, err := Unmarshal([]byte(`{"type":"something-new","x":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, ok := m.(Unknown); !ok || u.Type != "something-new" || string(u.Raw) != `{"type":"something-new","x":1}` {
+		t.Errorf("unexpected message %#v", m)
+	}
+
+	if _, err := Unmarshal([]byte(`{"type":"hello","version":"one"}`)); err == nil {
+		t.Errorf("expected error for bad hello")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// changeSet is a deduplicated set of changed files along with every
+// operation seen on each one.
+type changeSet map[string]fsnotify.Op
+
+func (cs changeSet) add(name string, op fsnotify.Op) {
+	cs[name] |= op
+}
+
+// paths returns the changed files in sorted order.
+func (cs changeSet) paths() []string {
+	ret := make([]string, 0, len(cs))
+	for p := range cs {
+		ret = append(ret, p)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// String returns e.g. `a.vugu (WRITE), b.go (CREATE|WRITE)`, with paths
+// relative to the current directory where possible.
+func (cs changeSet) String() string {
+	wd, _ := os.Getwd()
+	var parts []string
+	for _, p := range cs.paths() {
+		name := p
+		if wd != "" {
+			if rel, err := filepath.Rel(wd, p); err == nil && !strings.HasPrefix(rel, "..") {
+				name = rel
+			}
+		}
+		parts = append(parts, name+" ("+cs[p].String()+")")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// relevantOps are the operations which count as a change, others (chmod) are dropped
+const relevantOps = fsnotify.Create | fsnotify.Write | fsnotify.Remove | fsnotify.Rename
+
+// coalescer batches file events into change sets.  A change set is sent on
+// Out once no event has arrived for the quiet period, or once maxWait has
+// passed since the first event of the batch, whichever is sooner.  This is a
+// trailing-edge debounce, editors writing several files (or the same file
+// several times) on save result in one change set.
+type coalescer struct {
+	Out chan changeSet
+
+	in      <-chan fsnotify.Event
+	quiet   time.Duration
+	maxWait time.Duration
+}
+
+func newCoalescer(in <-chan fsnotify.Event, quiet, maxWait time.Duration) *coalescer {
+	return &coalescer{
+		Out:     make(chan changeSet, 1),
+		in:      in,
+		quiet:   quiet,
+		maxWait: maxWait,
+	}
+}
+
+// run reads events until stop is closed or in is closed.
+func (c *coalescer) run(stop <-chan struct{}) {
+
+	var cs changeSet
+	var batchStart time.Time
+
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	for {
+		select {
+
+		case <-stop:
+			timer.Stop()
+			return
+
+		case event, ok := <-c.in:
+			if !ok {
+				timer.Stop()
+				return
+			}
+
+			if *flagV {
+				log.Printf("DEBUG: watcher: %q %v", event.Name, event.Op)
+			}
+			if event.Op&relevantOps == 0 {
+				continue
+			}
+
+			now := time.Now()
+			if cs == nil {
+				cs = make(changeSet)
+				batchStart = now
+			}
+			cs.add(event.Name, event.Op&relevantOps)
+
+			// fire after the quiet period but never later than maxWait from the start of the batch
+			wait := c.quiet
+			if c.maxWait > 0 {
+				if left := batchStart.Add(c.maxWait).Sub(now); left < wait {
+					wait = left
+				}
+			}
+			if !timer.Stop() {
+				select { // drain if it fired but we didn't read it yet
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+
+		case <-timer.C:
+			if cs == nil {
+				continue
+			}
+			c.Out <- cs
+			cs = nil
+
+		}
+	}
+
+}
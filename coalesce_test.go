@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestCoalescer(t *testing.T) {
+
+	in := make(chan fsnotify.Event)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	co := newCoalescer(in, 50*time.Millisecond, 300*time.Millisecond)
+	go co.run(stop)
+
+	// a burst becomes one deduplicated change set
+	in <- fsnotify.Event{Name: "/a.vugu", Op: fsnotify.Write}
+	in <- fsnotify.Event{Name: "/b.go", Op: fsnotify.Create}
+	in <- fsnotify.Event{Name: "/a.vugu", Op: fsnotify.Write}
+	in <- fsnotify.Event{Name: "/b.go", Op: fsnotify.Write}
+	in <- fsnotify.Event{Name: "/c.go", Op: fsnotify.Chmod}
+
+	select {
+	case cs := <-co.Out:
+		if len(cs) != 2 || cs["/a.vugu"] != fsnotify.Write || cs["/b.go"] != fsnotify.Create|fsnotify.Write {
+			t.Errorf("unexpected change set: %v", cs)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for change set")
+	}
+
+	// events that never go quiet still fire once max wait is reached
+	start := time.Now()
+	done := make(chan changeSet, 1)
+	go func() { done <- <-co.Out }()
+	var cs changeSet
+loop:
+	for {
+		select {
+		case cs = <-done:
+			break loop
+		case in <- fsnotify.Event{Name: "/d.go", Op: fsnotify.Write}:
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if time.Since(start) > 600*time.Millisecond {
+		t.Errorf("max wait not honored, took %v", time.Since(start))
+	}
+	if cs["/d.go"] != fsnotify.Write {
+		t.Errorf("unexpected change set: %v", cs)
+	}
+}
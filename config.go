@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configFileName is the name of the project config file, looked for in the
+// current directory and its parents up to the go.mod root.
+const configFileName = "vgrun.json"
+
+// config holds the settings which drive the runner, watcher and auto-reloader.
+//
+// Values are layered, each one overriding the last: flag defaults, the project
+// config file, VGRUN_* environment variables and finally flags given on the
+// command line.  The json tag of each field is also the name of the flag it
+// corresponds to (if any) and the environment variable name is derived from
+// it, e.g. watch-pattern -> VGRUN_WATCH_PATTERN.  Fields tagged vgrun:"path"
+// are resolved relative to the directory of the config file they came from.
+type config struct {
+	Verbose      bool        `json:"v"`
+	WatchPattern string      `json:"watch-pattern"`
+	WatchDir     string      `json:"watch-dir" vgrun:"path"`
+	WatchExclude []string    `json:"watch-exclude"`
+	Rules        changeRules `json:"rules"`
+
+	Debounce        duration `json:"debounce"`
+	DebounceMaxWait duration `json:"debounce-max-wait"`
+
+	BinDir           string        `json:"bin-dir" vgrun:"path"`
+	NoGenerate       bool          `json:"no-generate"`
+	GenerateDirs     []string      `json:"generate-dirs" vgrun:"path"`
+	GenerateAuto     bool          `json:"generate-auto"`
+	GenerateParallel int           `json:"generate-parallel"`
+	CancelBuilds     bool          `json:"cancel-builds"`
+	Restart          restartPolicy `json:"restart"`
+	Listen           string        `json:"listen"`
+	EnvFiles         []string      `json:"env-files" vgrun:"path"`
+	Tags             []string      `json:"tags"`
+	LDFlags          string        `json:"ldflags"`
+	GCFlags          string        `json:"gcflags"`
+	Race             bool          `json:"race"`
+	TrimPath         bool          `json:"trimpath"`
+	AutoReloadAt     string        `json:"auto-reload-at"`
+	TimingHistory    int           `json:"timing-history"`
+	LogBuffer        int           `json:"log-buffer"`
+	LogPrefix        bool          `json:"log-prefix"`
+	LogColor         bool          `json:"log-color"`
+	LogInclude       string        `json:"log-include"`
+	LogExclude       string        `json:"log-exclude"`
+	LogDir           string        `json:"log-dir" vgrun:"path"`
+	LogKeep          int           `json:"log-keep"`
+	LogBrowserRate   int           `json:"log-browser-rate"`
+	BrowserConsole   string        `json:"browser-console"`
+	JSONFile         string        `json:"json-file" vgrun:"path"`
+	BuildTarget      string        `json:"build-target" vgrun:"path"`
+	Args             []string      `json:"args"`
+
+	Targets targetConfigs `json:"targets"`
+	Stages  stageConfigs  `json:"stages"`
+
+	path    string            // config file that was loaded, empty if none
+	sources map[string]string // where each value came from, by key
+}
+
+// findConfigFile walks up from dir looking for configFileName.  The search
+// stops after the first directory containing a go.mod file.  An empty string
+// is returned if no config file was found.
+func findConfigFile(dir string) (string, error) {
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		p := filepath.Join(dir, configFileName)
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return "", nil // module root, stop here
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+
+}
+
+// loadConfig builds the effective config from the defaults and explicitly set
+// flags in fs, the config file at path (discovered if empty) and the environment.
+func loadConfig(fs *flag.FlagSet, path string) (*config, error) {
+
+	cfg := &config{sources: make(map[string]string)}
+
+	// defaults come from the flag definitions
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		fv, ok := cfg.field(f.Name)
+		if !ok {
+			return
+		}
+		if err = setFromString(fv, f.DefValue); err != nil {
+			err = fmt.Errorf("default for -%s: %w", f.Name, err)
+			return
+		}
+		cfg.sources[f.Name] = "default"
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if path == "" {
+		path, err = findConfigFile(".")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if path != "" {
+		err = cfg.loadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, key := range cfg.keys() {
+		name := envName(key)
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		fv, _ := cfg.field(key)
+		if err := setFromString(fv, s); err != nil {
+			return nil, fmt.Errorf("environment variable %s: %w", name, err)
+		}
+		cfg.sources[key] = "env " + name
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		fv, ok := cfg.field(f.Name)
+		if !ok {
+			return
+		}
+		if err = setFromString(fv, f.Value.String()); err != nil {
+			err = fmt.Errorf("flag -%s: %w", f.Name, err)
+			return
+		}
+		cfg.sources[f.Name] = "flag -" + f.Name
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// loadFile reads the JSON config file at path and applies each key in it.
+// Unknown keys are an error so typos don't go unnoticed.
+func (cfg *config) loadFile(path string) error {
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var m map[string]json.RawMessage
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return fmt.Errorf("error parsing config file %q: %w", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	for key, raw := range m {
+		fv, ok := cfg.field(key)
+		if !ok {
+			return fmt.Errorf("config file %q: unknown key %q", path, key)
+		}
+		pv := reflect.New(fv.Type())
+		if err := json.Unmarshal(raw, pv.Interface()); err != nil {
+			return fmt.Errorf("config file %q: key %q: %w", path, key, err)
+		}
+		fv.Set(pv.Elem())
+		if cfg.isPath(key) && fv.Kind() == reflect.String {
+			fv.SetString(resolvePath(dir, fv.String()))
+		}
+		if cfg.isPath(key) && fv.Kind() == reflect.Slice {
+			for i := 0; i < fv.Len(); i++ {
+				fv.Index(i).SetString(resolvePath(dir, fv.Index(i).String()))
+			}
+		}
+		if r, ok := fv.Interface().(pathResolver); ok {
+			r.resolvePaths(dir)
+		}
+		cfg.sources[key] = "file " + path
+	}
+
+	cfg.path = path
+	return nil
+}
+
+// pathResolver is implemented by structured config values which contain
+// paths that need resolving relative to the config file.
+type pathResolver interface {
+	resolvePaths(dir string)
+}
+
+// setArgs applies the positional command line arguments, which name the build
+// target followed by the arguments to pass to it.  A target given on the command
+// line replaces any targets from the config file.
+func (cfg *config) setArgs(args []string) {
+	if len(args) == 0 {
+		return
+	}
+	cfg.BuildTarget = args[0]
+	cfg.Args = args[1:]
+	cfg.sources["build-target"] = "command line"
+	cfg.sources["args"] = "command line"
+	if cfg.Targets != nil {
+		cfg.Targets = nil
+		cfg.sources["targets"] = "command line (replaced by build-target)"
+	}
+}
+
+// targetConfigs returns each target to run, including the one described by
+// build-target and args if set, which also gets listen and the build flags.
+func (cfg *config) targetConfigs() []targetConfig {
+	ret := append([]targetConfig(nil), cfg.Targets...)
+	if cfg.BuildTarget != "" {
+		ret = append(ret, targetConfig{
+			Build:  cfg.BuildTarget,
+			Args:   cfg.Args,
+			Listen: cfg.Listen,
+			buildConfig: buildConfig{
+				Tags:     cfg.Tags,
+				LDFlags:  cfg.LDFlags,
+				GCFlags:  cfg.GCFlags,
+				Race:     cfg.Race,
+				TrimPath: cfg.TrimPath,
+			},
+		})
+	}
+	return ret
+}
+
+// print writes the effective config to w, one key per line along with where its value came from.
+func (cfg *config) print(w io.Writer) error {
+
+	if cfg.path != "" {
+		fmt.Fprintf(w, "# config file: %s\n", cfg.path)
+	} else {
+		fmt.Fprintf(w, "# config file: none found\n")
+	}
+
+	keys := cfg.keys()
+	width := 0
+	for _, key := range keys {
+		if len(key) > width {
+			width = len(key)
+		}
+	}
+
+	for _, key := range keys {
+		fv, _ := cfg.field(key)
+		b, err := json.Marshal(fv.Interface())
+		if err != nil {
+			return err
+		}
+		src := cfg.sources[key]
+		if src == "" {
+			src = "unset"
+		}
+		_, err = fmt.Fprintf(w, "%-*s = %s  # %s\n", width, key, b, src)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// keys returns the config keys in sorted order.
+func (cfg *config) keys() []string {
+	t := reflect.TypeOf(cfg).Elem()
+	var ret []string
+	for i := 0; i < t.NumField(); i++ {
+		if key := configKey(t.Field(i)); key != "" {
+			ret = append(ret, key)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// field returns the settable struct field for key.
+func (cfg *config) field(key string) (reflect.Value, bool) {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if configKey(t.Field(i)) == key {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func (cfg *config) isPath(key string) bool {
+	t := reflect.TypeOf(cfg).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		if configKey(t.Field(i)) == key {
+			return t.Field(i).Tag.Get("vgrun") == "path"
+		}
+	}
+	return false
+}
+
+func configKey(sf reflect.StructField) string {
+	if sf.PkgPath != "" { // unexported
+		return ""
+	}
+	return strings.Split(sf.Tag.Get("json"), ",")[0]
+}
+
+// envName returns the environment variable which overrides key.
+func envName(key string) string {
+	return "VGRUN_" + strings.ToUpper(strings.Replace(key, "-", "_", -1))
+}
+
+// setFromString parses s according to the kind of v and assigns it.
+// Slices of strings are comma separated.
+func setFromString(v reflect.Value, s string) error {
+	if v.Type() == reflect.TypeOf(duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %v", v.Type())
+		}
+		var parts []string
+		if s != "" {
+			parts = strings.Split(s, ",")
+		}
+		v.Set(reflect.ValueOf(parts))
+	default:
+		return fmt.Errorf("unsupported type %v", v.Type())
+	}
+	return nil
+}
+
+// duration is a time.Duration written as a string such as "300ms" in the config file.
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	td, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(td)
+	return nil
+}
+
+// resolvePath returns p relative to dir, expressed relative to the current
+// directory where possible so log output stays readable.
+func resolvePath(dir, p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	abs, err := filepath.Abs(filepath.Join(dir, p))
+	if err != nil {
+		return filepath.Join(dir, p)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return abs
+	}
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil {
+		return abs
+	}
+	return rel
+}
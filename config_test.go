@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+
+	tmpDir, err := ioutil.TempDir("", "TestLoadConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	sub := filepath.Join(tmpDir, "a", "b")
+	must(t, os.MkdirAll(sub, 0755))
+	must(t, ioutil.WriteFile(filepath.Join(tmpDir, "go.mod"), []byte("module example.com/x\n"), 0644))
+	must(t, ioutil.WriteFile(filepath.Join(tmpDir, configFileName), []byte(`{
+		"watch-pattern": "\\.(vugu|go)$",
+		"bin-dir": "out/bin",
+		"no-generate": true,
+		"auto-reload-at": "localhost:9000"
+	}`), 0644))
+
+	p, err := findConfigFile(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != filepath.Join(tmpDir, configFileName) {
+		t.Fatalf("findConfigFile returned %q", p)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("watch-pattern", "\\.vugu$", "")
+	fs.String("bin-dir", "bin", "")
+	fs.Bool("no-generate", false, "")
+	fs.String("auto-reload-at", "localhost:8324", "")
+	fs.String("watch-dir", ".", "")
+	must(t, fs.Parse([]string{"-no-generate=false"}))
+
+	os.Setenv("VGRUN_AUTO_RELOAD_AT", "localhost:9001")
+	defer os.Unsetenv("VGRUN_AUTO_RELOAD_AT")
+
+	cfg, err := loadConfig(fs, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.WatchPattern != `\.(vugu|go)$` {
+		t.Errorf("unexpected WatchPattern %q", cfg.WatchPattern)
+	}
+	// relative to the config file, expressed relative to the current dir
+	if abs, _ := filepath.Abs(cfg.BinDir); abs != filepath.Join(tmpDir, "out", "bin") {
+		t.Errorf("unexpected BinDir %q, want %q", cfg.BinDir, filepath.Join(tmpDir, "out", "bin"))
+	}
+	if cfg.NoGenerate {
+		t.Errorf("flag should override config file for no-generate")
+	}
+	if cfg.AutoReloadAt != "localhost:9001" {
+		t.Errorf("env should override config file for auto-reload-at, got %q", cfg.AutoReloadAt)
+	}
+	if cfg.WatchDir != "." || cfg.sources["watch-dir"] != "default" {
+		t.Errorf("unexpected watch-dir %q from %q", cfg.WatchDir, cfg.sources["watch-dir"])
+	}
+
+	var buf bytes.Buffer
+	must(t, cfg.print(&buf))
+	if !strings.Contains(buf.String(), "# flag -no-generate") || !strings.Contains(buf.String(), "# env VGRUN_AUTO_RELOAD_AT") {
+		t.Errorf("unexpected print output:\n%s", buf.String())
+	}
+
+	must(t, ioutil.WriteFile(p, []byte(`{"no-such-key": 1}`), 0644))
+	_, err = loadConfig(fs, p)
+	if err == nil {
+		t.Errorf("expected error for unknown key")
+	}
+
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vugu/vgrun/autoreload"
+)
+
+// diagnostic is a single problem reported by go generate (including vugugen),
+// go build or vet, pointing at a location in a source file.
+type diagnostic = autoreload.Diagnostic
+
+// buildReport is the outcome of one generate and build cycle.
+type buildReport = autoreload.BuildResult
+
+// buildReporter is told the result of every build.
+type buildReporter interface {
+	buildReport(br *buildReport)
+}
+
+// buildStarter is a buildReporter which is also told when builds start.
+type buildStarter interface {
+	buildStart(targets []string)
+}
+
+// buildError is a generate or build failure along with the problems parsed from its output.
+type buildError struct {
+	stage  string
+	target string
+	err    error
+	output []byte
+	diags  []diagnostic
+}
+
+func newBuildError(stage, target, dir string, err error, output []byte) *buildError {
+	return &buildError{
+		stage:  stage,
+		target: target,
+		err:    err,
+		output: output,
+		diags:  parseDiagnostics(stage, target, dir, output),
+	}
+}
+
+func (e *buildError) Error() string {
+	s := fmt.Sprintf("%s error: %v; full output:\n%s", e.stage, e.err, e.output)
+	if e.target != "" {
+		s = e.target + ": " + s
+	}
+	return s
+}
+
+func (e *buildError) Unwrap() error {
+	return e.err
+}
+
+// buildErrors is every failure from one cycle.
+type buildErrors []*buildError
+
+func (es buildErrors) Error() string {
+	var parts []string
+	for _, e := range es {
+		parts = append(parts, e.Error())
+	}
+	return strings.Join(parts, "\n")
+}
+
+// diagnostics returns the parsed problems from all the errors.
+func (es buildErrors) diagnostics() []diagnostic {
+	var ret []diagnostic
+	for _, e := range es {
+		ret = append(ret, e.diags...)
+	}
+	return ret
+}
+
+// diagLineRE matches "file:line:col: message" and "file:line: message" anywhere in
+// a line, so prefixes like "vet: " or "vugugen: " are skipped over.
+var diagLineRE = regexp.MustCompile(`((?:[A-Za-z]:)?[^\s:]+\.\w+):(\d+)(?::(\d+))?: ?(.*)$`)
+
+// parseDiagnostics extracts the problems from the output of a go command
+// which ran in dir.  Lines which aren't problems (e.g. "# package") are skipped.
+func parseDiagnostics(stage, target, dir string, output []byte) []diagnostic {
+
+	wd, _ := os.Getwd()
+
+	var ret []diagnostic
+	sc := bufio.NewScanner(bytes.NewReader(output))
+	for sc.Scan() {
+		line := sc.Text()
+		m := diagLineRE.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+
+		d := diagnostic{Stage: stage, Target: target, File: m[1], Message: strings.TrimSpace(m[4])}
+		d.Line, _ = strconv.Atoi(m[2])
+		d.Column, _ = strconv.Atoi(m[3])
+
+		prefix := line[:strings.Index(line, m[0])]
+		switch {
+		case strings.HasPrefix(prefix, "vet:"):
+			d.Stage = "vet"
+		case stage == "generate" && (strings.Contains(prefix, "vugugen") || filepath.Ext(d.File) == ".vugu"):
+			d.Stage = "vugugen"
+		}
+
+		// paths are relative to where the command ran, make them relative to us instead
+		f := filepath.FromSlash(d.File)
+		if !filepath.IsAbs(f) {
+			f = filepath.Join(dir, f)
+		}
+		if wd != "" {
+			if rel, err := filepath.Rel(wd, f); err == nil && !strings.HasPrefix(rel, "..") {
+				f = rel
+			}
+		}
+		d.File = f
+
+		ret = append(ret, d)
+	}
+
+	return ret
+}
+
+// printBuildReport writes a human readable summary of a failed build to w.
+// Nothing is written for successful builds.
+func printBuildReport(w io.Writer, br *buildReport) {
+	if br.Success {
+		return
+	}
+	if len(br.Diagnostics) == 0 { // nothing we could parse, show it all
+		fmt.Fprintf(w, "generate or build failure:\n%s\n", strings.Join(br.Errors, "\n"))
+		return
+	}
+	fmt.Fprintf(w, "generate or build failure (%d problems):\n", len(br.Diagnostics))
+	for _, d := range br.Diagnostics {
+		if d.Target != "" {
+			fmt.Fprintf(w, "  [%s %s] %v\n", d.Target, d.Stage, d)
+		} else {
+			fmt.Fprintf(w, "  [%s] %v\n", d.Stage, d)
+		}
+	}
+}
+
+// jsonReporter writes each build report to w as a line of JSON.
+type jsonReporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (jr *jsonReporter) buildReport(br *buildReport) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	b, err := autoreload.Marshal(br)
+	if err != nil {
+		panic(err)
+	}
+	jr.w.Write(append(b, '\n'))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestParseDiagnostics(t *testing.T) {
+
+	out := []byte(`# example.com/proj/server
+./main.go:12:2: undefined: foo
+./main.go:15: missing return
+vet: ./util.go:3:6: fmt.Printf format %d has arg s of wrong type string
+note: module requires Go 1.99
+`)
+	diags := parseDiagnostics("build", "server", "server", out)
+	if len(diags) != 3 {
+		t.Fatalf("expected 3 diagnostics, got %d: %v", len(diags), diags)
+	}
+
+	want := diagnostic{Stage: "build", Target: "server", File: filepath.Join("server", "main.go"), Line: 12, Column: 2, Message: "undefined: foo"}
+	if diags[0] != want {
+		t.Errorf("got %#v, want %#v", diags[0], want)
+	}
+	if diags[1].Line != 15 || diags[1].Column != 0 || diags[1].Message != "missing return" {
+		t.Errorf("unexpected %#v", diags[1])
+	}
+	if diags[2].Stage != "vet" || diags[2].File != filepath.Join("server", "util.go") {
+		t.Errorf("unexpected %#v", diags[2])
+	}
+
+	out = []byte(`vugugen: error processing root.vugu:4:10: unexpected end tag
+generate.go:3: running "vugugen": exit status 1
+`)
+	diags = parseDiagnostics("generate", "", ".", out)
+	if len(diags) != 2 {
+		t.Fatalf("expected 2 diagnostics, got %d: %v", len(diags), diags)
+	}
+	if diags[0].Stage != "vugugen" || diags[0].File != "root.vugu" || diags[0].Message != "unexpected end tag" {
+		t.Errorf("unexpected %#v", diags[0])
+	}
+	if diags[1].Stage != "generate" || diags[1].File != "generate.go" || diags[1].Line != 3 {
+		t.Errorf("unexpected %#v", diags[1])
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// loadEnvFiles reads each dotenv file in turn and returns the variables as
+// KEY=value pairs, later files overriding earlier ones.  Missing files are
+// skipped so optional ones (e.g. .env.local) can be listed.
+func loadEnvFiles(paths []string) ([]string, error) {
+
+	vars := make(map[string]string)
+	var keys []string
+
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if os.IsNotExist(err) {
+			if *flagV {
+				log.Printf("Env file %q not found, skipping", p)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		kvs, err := parseDotenv(f, func(k string) string {
+			if v, ok := vars[k]; ok {
+				return v
+			}
+			return os.Getenv(k)
+		})
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		if *flagV {
+			log.Printf("Loaded env file %q: %s", p, redactEnv(kvs))
+		}
+		for _, kv := range kvs {
+			i := strings.IndexByte(kv, '=')
+			k := kv[:i]
+			if _, ok := vars[k]; !ok {
+				keys = append(keys, k)
+			}
+			vars[k] = kv[i+1:]
+		}
+	}
+
+	ret := make([]string, 0, len(keys))
+	for _, k := range keys {
+		ret = append(ret, k+"="+vars[k])
+	}
+	return ret, nil
+}
+
+// parseDotenv reads lines of KEY=value from r.  Blank lines and lines starting
+// with # are skipped, as is a leading "export ".  Values may be single quoted
+// (taken literally), double quoted (\n, \", \\ escapes and ${VAR} expansion) or
+// unquoted (trimmed, ${VAR} expanded, a " #" starts a comment).  lookup is
+// used for ${VAR}, variables set earlier in the same file take precedence.
+func parseDotenv(r io.Reader, lookup func(string) string) ([]string, error) {
+
+	var ret []string
+	local := make(map[string]string)
+	expand := func(s string) string {
+		return os.Expand(s, func(k string) string {
+			if v, ok := local[k]; ok {
+				return v
+			}
+			return lookup(k)
+		})
+	}
+
+	sc := bufio.NewScanner(r)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		i := strings.IndexByte(line, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected KEY=value", lineNo)
+		}
+		k := strings.TrimSpace(line[:i])
+		v := strings.TrimSpace(line[i+1:])
+
+		switch {
+
+		case strings.HasPrefix(v, "'"):
+			end := strings.IndexByte(v[1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated single quote", lineNo)
+			}
+			v = v[1 : end+1]
+
+		case strings.HasPrefix(v, `"`):
+			var sb strings.Builder
+			closed := false
+		dq:
+			for j := 1; j < len(v); j++ {
+				c := v[j]
+				switch {
+				case c == '"':
+					closed = true
+					break dq
+				case c == '\\' && j+1 < len(v):
+					j++
+					switch v[j] {
+					case 'n':
+						sb.WriteByte('\n')
+					case 't':
+						sb.WriteByte('\t')
+					default:
+						sb.WriteByte(v[j])
+					}
+				default:
+					sb.WriteByte(c)
+				}
+			}
+			if !closed {
+				return nil, fmt.Errorf("line %d: unterminated double quote", lineNo)
+			}
+			v = expand(sb.String())
+
+		default:
+			if j := strings.Index(v, " #"); j >= 0 {
+				v = strings.TrimSpace(v[:j])
+			}
+			v = expand(v)
+
+		}
+
+		local[k] = v
+		ret = append(ret, k+"="+v)
+	}
+
+	return ret, sc.Err()
+}
+
+// redactEnv returns KEY=value pairs for logging with the values hidden.
+func redactEnv(kvs []string) string {
+	parts := make([]string, 0, len(kvs))
+	for _, kv := range kvs {
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			kv = kv[:i] + "=<redacted>"
+		}
+		parts = append(parts, kv)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDotenv(t *testing.T) {
+
+	src := `
+# comment
+PORT=8844
+export HOST = localhost
+URL=http://${HOST}:${PORT} # trailing comment
+RAW='${HOST} # not a comment'
+MSG="line one\nsay \"hi\" to ${USER}"
+EMPTY=
+`
+	lookup := func(k string) string {
+		if k == "USER" {
+			return "joe"
+		}
+		return ""
+	}
+
+	kvs, err := parseDotenv(strings.NewReader(src), lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"PORT=8844",
+		"HOST=localhost",
+		"URL=http://localhost:8844",
+		"RAW=${HOST} # not a comment",
+		"MSG=line one\nsay \"hi\" to joe",
+		"EMPTY=",
+	}
+	if !reflect.DeepEqual(kvs, want) {
+		t.Errorf("unexpected result:\n%q\nwant:\n%q", kvs, want)
+	}
+
+	if s := redactEnv(kvs[:2]); s != "PORT=<redacted> HOST=<redacted>" {
+		t.Errorf("unexpected redacted output %q", s)
+	}
+
+	_, err = parseDotenv(strings.NewReader(`A="unterminated`), lookup)
+	if err == nil {
+		t.Errorf("expected error for unterminated quote")
+	}
+
+}
+
+func TestEnvFileRestarts(t *testing.T) {
+
+	// env file changes survive merging with rebuilds, even ones of everything
+	r := runStateChangeReq{changes: []string{"main.go"}, restarts: []string{".env"}}.merge(runStateChangeReq{})
+	if !reflect.DeepEqual(r.restarts, []string{".env"}) {
+		t.Errorf("unexpected restarts %v", r.restarts)
+	}
+
+	a := &target{name: "a", envFiles: []string{".env"}}
+	b := &target{name: "b"}
+	ru := &runner{targets: []*target{a, b}}
+	if got := mergeTargets([]*target{b}, ru.restartTargets(r.restarts)); !reflect.DeepEqual(got, []*target{b, a}) {
+		t.Errorf("unexpected targets %v", got)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// generateDirsFor returns the dirs to run go generate in for req: the ones
+// with a change somewhere under them.  If req doesn't say what changed (or
+// none of the changes are under a generate dir) all of them are returned.
+func (ru *runner) generateDirsFor(req runStateChangeReq, all bool) []string {
+
+	dirs := ru.generateDirs
+	if ru.generateAuto {
+		dirs = discoverGenerateDirs(".")
+	}
+	if all || req.unknown() {
+		return dirs
+	}
+
+	var ret []string
+	for _, d := range dirs {
+		absd, err := filepath.Abs(d)
+		if err != nil {
+			return dirs
+		}
+		for _, p := range append(append([]string(nil), req.changes...), req.inputs...) {
+			absp, err := filepath.Abs(p)
+			if err != nil {
+				return dirs
+			}
+			if rel, err := filepath.Rel(absd, absp); err == nil && !strings.HasPrefix(rel, "..") {
+				ret = append(ret, d)
+				break
+			}
+		}
+	}
+	if len(ret) == 0 {
+		return dirs
+	}
+	return ret
+}
+
+// generate runs go generate in each of dirs, up to generateParallel at a time.
+func (ru *runner) generate(ctx context.Context, dirs []string) error {
+
+	n := ru.generateParallel
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	sem := make(chan struct{}, n)
+
+	errs := make([]*buildError, len(dirs))
+	var wg sync.WaitGroup
+	for i, dir := range dirs {
+		wg.Add(1)
+		go func(i int, dir string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if ctx.Err() != nil {
+				return
+			}
+
+			cmd := exec.Command("go", "generate")
+			cmd.Dir = dir
+			if *flagV {
+				log.Printf("About to execute go: %v (dir=%v)", cmd.Args, cmd.Dir)
+			}
+			b, err := combinedOutputContext(ctx, cmd)
+			if err != nil {
+				if *flagV {
+					log.Printf("go generate error (dir=%v): %v", cmd.Dir, err)
+				}
+				errs[i] = newBuildError("generate", "", cmd.Dir, err, b)
+			}
+		}(i, dir)
+	}
+	wg.Wait()
+
+	var ret buildErrors
+	for _, e := range errs {
+		if e != nil {
+			ret = append(ret, e)
+		}
+	}
+	if len(ret) > 0 {
+		return ret
+	}
+	return nil
+}
+
+// discoverGenerateDirs returns each dir under root with a .go file containing
+// a //go:generate directive.  Hidden dirs, vendor, node_modules and testdata
+// are skipped, as the go tool does.
+func discoverGenerateDirs(root string) []string {
+
+	var ret []string
+	found := make(map[string]bool)
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		name := info.Name()
+		if info.IsDir() {
+			if p != root && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") ||
+				name == "vendor" || name == "node_modules" || name == "testdata") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(name) != ".go" {
+			return nil
+		}
+		dir := filepath.Dir(p)
+		if found[dir] {
+			return nil // already found one here, maybe before a subdir
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil
+		}
+		sc := bufio.NewScanner(bytes.NewReader(b))
+		for sc.Scan() {
+			if bytes.HasPrefix(sc.Bytes(), []byte("//go:generate ")) {
+				ret = append(ret, dir)
+				found[dir] = true
+				break
+			}
+		}
+		return nil
+	})
+
+	if *flagV {
+		log.Printf("Found go:generate directives in: %v", ret)
+	}
+	return ret
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateDirs(t *testing.T) {
+
+	tmpDir, err := ioutil.TempDir("", "TestGenerateDirs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, d := range []string{"a", "b/c", "node_modules/x", ".hidden"} {
+		must(t, os.MkdirAll(filepath.Join(tmpDir, d), 0755))
+		must(t, ioutil.WriteFile(filepath.Join(tmpDir, d, "gen.go"), []byte("package x\n\n//go:generate echo hi\n"), 0644))
+	}
+	must(t, ioutil.WriteFile(filepath.Join(tmpDir, "b", "main.go"), []byte("package main\n"), 0644))
+	// a/h is walked between a/gen.go and a/z.go, a must still only be listed once
+	must(t, os.MkdirAll(filepath.Join(tmpDir, "a", "h"), 0755))
+	must(t, ioutil.WriteFile(filepath.Join(tmpDir, "a", "h", "x.go"), []byte("package y\n\n//go:generate echo hi\n"), 0644))
+	must(t, ioutil.WriteFile(filepath.Join(tmpDir, "a", "z.go"), []byte("package x\n\n//go:generate echo hi\n"), 0644))
+
+	dirs := discoverGenerateDirs(tmpDir)
+	want := fmt.Sprint([]string{filepath.Join(tmpDir, "a"), filepath.Join(tmpDir, "a", "h"), filepath.Join(tmpDir, "b", "c")})
+	if fmt.Sprint(dirs) != want {
+		t.Errorf("discovered %v, want %v", dirs, want)
+	}
+
+	// only dirs with changes under them, all of them when that's unknown
+	ru := &runner{generateDirs: dirs}
+	got := ru.generateDirsFor(runStateChangeReq{changes: []string{filepath.Join(tmpDir, "b", "c", "x.vugu")}}, false)
+	if fmt.Sprint(got) != fmt.Sprint(dirs[2:]) {
+		t.Errorf("unexpected dirs for change: %v", got)
+	}
+	if got := ru.generateDirsFor(runStateChangeReq{}, false); len(got) != 3 {
+		t.Errorf("unexpected dirs for unknown change: %v", got)
+	}
+
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+)
+
+// With listen set on a target, vgrun owns the listening socket and every
+// process started for the target inherits it as fd 3, following the
+// LISTEN_FDS/LISTEN_PID convention used by systemd socket activation.  As the
+// socket stays open across restarts, the new process is started before the
+// old one is stopped and connections are never refused.
+//
+// LISTEN_PID has to be the pid of the process itself, which isn't known until
+// it has started.  So vgrun starts a copy of itself with listenExecArg, which
+// sets LISTEN_PID to its own pid and then execs the real binary in its place.
+
+// listenExecArg as the first argument makes vgrun exec the program which follows, see listenExec.
+const listenExecArg = "-vgrun-listen-exec"
+
+// listenFD is the descriptor the socket is passed on, the first after stdin, stdout and stderr.
+const listenFD = 3
+
+// handoff is the previous process of a target with listen set, it keeps serving
+// until the process replacing it is ready.
+type handoff struct {
+	cmd      *exec.Cmd
+	cmdErrCh chan error
+}
+
+// openListenFile returns the socket for t.listen, listening on first use.
+func (t *target) openListenFile() (*os.File, error) {
+	if t.listenFile != nil {
+		return t.listenFile, nil
+	}
+	l, err := net.Listen("tcp", t.listen)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close() // File returns a dup, which is what we keep
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		return nil, err
+	}
+	t.listenFile = f
+	return f, nil
+}
+
+// listenCmd returns a command which runs path with args, passing it the socket
+// for t.  The caller sets LISTEN_FDS and LISTEN_FDNAMES in its environment.
+func (t *target) listenCmd(path string, args []string) (*exec.Cmd, error) {
+
+	f, err := t.openListenFile()
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %q: %w", t.listen, err)
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(self, append([]string{listenExecArg, path}, args...)...)
+	cmd.ExtraFiles = []*os.File{f} // becomes listenFD
+	return cmd, nil
+}
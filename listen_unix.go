@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+const listenSupported = true
+
+// listenExec runs in the copy of vgrun started by listenCmd, args is the
+// program and its arguments.  It only returns if the exec fails.
+func listenExec(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s: missing program", listenExecArg)
+	}
+	// the pid doesn't change across exec, so this is the pid of the program
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	return syscall.Exec(args[0], args, os.Environ())
+}
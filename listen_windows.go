@@ -0,0 +1,10 @@
+package main
+
+import "fmt"
+
+// listenSupported is false as Windows processes can't inherit sockets as file descriptors.
+const listenSupported = false
+
+func listenExec(args []string) error {
+	return fmt.Errorf("listen is not supported on Windows")
+}
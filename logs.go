@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vugu/vgrun/autoreload"
+)
+
+// logLine is one line of output from a process.
+type logLine = autoreload.Log
+
+// logRing keeps the most recent lines written by a target.
+type logRing struct {
+	lines []logLine
+	next  int // where the next line goes once lines is full
+}
+
+func (r *logRing) add(size int, l logLine) {
+	if len(r.lines) < size {
+		r.lines = append(r.lines, l)
+		return
+	}
+	r.lines[r.next] = l
+	r.next = (r.next + 1) % len(r.lines)
+}
+
+// list returns a copy of the lines, oldest first.
+func (r *logRing) list() []logLine {
+	ret := make([]logLine, 0, len(r.lines))
+	ret = append(ret, r.lines[r.next:]...)
+	return append(ret, r.lines[:r.next]...)
+}
+
+// logSubscriber is told about every line of process output, whether or not
+// it's printed.  It must not block.
+type logSubscriber interface {
+	logLine(l logLine)
+}
+
+// logFileRE matches what follows "<target>-" in the name of a run log.
+var logFileRE = regexp.MustCompile(`^\d{8}-\d{6}\.\d{3}-b\d+\.log$`)
+
+// logColors are the ANSI colors target names are printed in, in order.
+var logColors = []string{"36", "33", "35", "32", "34", "31"}
+
+// logCapture collects the output of the processes.  Each line is kept in a
+// ring buffer per target, printed to our stdout or stderr (unless filtered
+// out) and optionally written to a log file for each run of a process.  Only
+// whole lines are printed, so output doesn't get mixed up with our own.
+type logCapture struct {
+	size    int            // lines kept per target, 0 means none
+	prefix  bool           // prefix printed lines with the target name
+	color   bool           // color the prefixes and highlight include matches
+	include *regexp.Regexp // only matching lines are printed, nil for all
+	exclude *regexp.Regexp // matching lines aren't printed, nil for none
+	dir     string         // where run logs are written, empty for none
+	keep    int            // how many run logs are kept per target
+
+	stdout, stderr io.Writer
+
+	subscribers []logSubscriber
+
+	mu     sync.Mutex
+	rings  map[string]*logRing
+	colors map[string]string
+}
+
+func newLogCapture() *logCapture {
+	return &logCapture{
+		size:   1000,
+		keep:   10,
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+		rings:  make(map[string]*logRing),
+		colors: make(map[string]string),
+	}
+}
+
+// runLog is the output of one run of a process.
+type runLog struct {
+	lc     *logCapture
+	target string
+	build  int
+	file   *os.File // nil if not written to a file
+
+	stdout, stderr *lineWriter
+}
+
+// start returns the runLog for a run of build of t, opening its log file
+// if there is one.  Failing to open it is logged but not fatal.
+func (lc *logCapture) start(t *target, build int) *runLog {
+
+	rl := &runLog{lc: lc, target: t.name, build: build}
+	rl.stdout = &lineWriter{rl: rl, stream: "stdout"}
+	rl.stderr = &lineWriter{rl: rl, stream: "stderr"}
+
+	if lc.dir != "" {
+		f, err := lc.openFile(t.name, build)
+		if err != nil {
+			log.Printf("Unable to open log file for %s: %v", t.name, err)
+		}
+		rl.file = f
+	}
+
+	return rl
+}
+
+// openFile creates the log file for a run, removing the oldest ones for
+// the same target so that no more than keep remain.
+func (lc *logCapture) openFile(name string, build int) (*os.File, error) {
+
+	err := os.MkdirAll(lc.dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	// the names sort oldest first
+	p := filepath.Join(lc.dir, fmt.Sprintf("%s-%s-b%d.log", name, time.Now().Format("20060102-150405.000"), build))
+	f, err := os.Create(p)
+	if err != nil {
+		return nil, err
+	}
+
+	// the glob also matches targets whose names start with name + "-"
+	var old []string
+	ps, _ := filepath.Glob(filepath.Join(lc.dir, name+"-*.log"))
+	for _, p := range ps {
+		if logFileRE.MatchString(strings.TrimPrefix(filepath.Base(p), name+"-")) {
+			old = append(old, p)
+		}
+	}
+	sort.Strings(old)
+	for len(old) > lc.keep && lc.keep > 0 {
+		if *flagV {
+			log.Printf("Removing old log file %s", old[0])
+		}
+		os.Remove(old[0])
+		old = old[1:]
+	}
+
+	return f, nil
+}
+
+// close prints any partial last lines and closes the log file.  It's called
+// once the process has exited.
+func (rl *runLog) close() {
+	rl.stdout.flush()
+	rl.stderr.flush()
+	if rl.file != nil {
+		rl.file.Close()
+	}
+}
+
+// line records a line of output.
+func (lc *logCapture) line(rl *runLog, stream, text string) {
+
+	l := logLine{Time: time.Now(), Target: rl.target, Build: rl.build, Stream: stream, Text: text}
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if lc.size > 0 {
+		r := lc.rings[l.Target]
+		if r == nil {
+			r = &logRing{}
+			lc.rings[l.Target] = r
+		}
+		r.add(lc.size, l)
+	}
+	for _, s := range lc.subscribers {
+		s.logLine(l)
+	}
+
+	if rl.file != nil {
+		fmt.Fprintf(rl.file, "%s %s %s\n", l.Time.Format("15:04:05.000"), stream, text)
+	}
+
+	if lc.include != nil && !lc.include.MatchString(text) {
+		return
+	}
+	if lc.exclude != nil && lc.exclude.MatchString(text) {
+		return
+	}
+
+	var buf bytes.Buffer
+	if lc.prefix {
+		if lc.color {
+			c := lc.colors[l.Target]
+			if c == "" {
+				c = logColors[len(lc.colors)%len(logColors)]
+				lc.colors[l.Target] = c
+			}
+			buf.WriteString("\x1b[" + c + "m[" + l.Target + "]\x1b[0m ")
+		} else {
+			buf.WriteString("[" + l.Target + "] ")
+		}
+	}
+	if lc.color && lc.include != nil {
+		buf.WriteString(lc.include.ReplaceAllString(text, "\x1b[1;7m${0}\x1b[0m"))
+	} else {
+		buf.WriteString(text)
+	}
+	buf.WriteByte('\n')
+
+	w := lc.stdout
+	if stream == "stderr" {
+		w = lc.stderr
+	}
+	w.Write(buf.Bytes())
+}
+
+// lines returns the buffered lines of target, or of every target if it's
+// empty, oldest first.
+func (lc *logCapture) lines(target string) []logLine {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	var ret []logLine
+	for name, r := range lc.rings {
+		if target == "" || target == name {
+			ret = append(ret, r.list()...)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Time.Before(ret[j].Time) })
+	return ret
+}
+
+// ServeHTTP responds with the buffered lines as JSON.  The target and n
+// (most recent lines only) query params narrow them down.
+func (lc *logCapture) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lines := lc.lines(r.URL.Query().Get("target"))
+	if n, err := strconv.Atoi(r.URL.Query().Get("n")); err == nil && n >= 0 && n < len(lines) {
+		lines = lines[len(lines)-n:]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lines)
+}
+
+// maxLogLine is how much of a line without a newline is held before it's
+// recorded anyway.
+const maxLogLine = 64 * 1024
+
+// lineWriter splits what a process writes to one stream into lines.
+type lineWriter struct {
+	rl     *runLog
+	stream string
+
+	mu  sync.Mutex
+	buf []byte // partial line from prior writes
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	lw.buf = append(lw.buf, p...)
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		lw.rl.lc.line(lw.rl, lw.stream, strings.TrimSuffix(string(lw.buf[:i]), "\r"))
+		lw.buf = lw.buf[i+1:]
+	}
+	if len(lw.buf) > maxLogLine {
+		lw.rl.lc.line(lw.rl, lw.stream, string(lw.buf))
+		lw.buf = nil
+	}
+	return len(p), nil
+}
+
+func (lw *lineWriter) flush() {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if len(lw.buf) > 0 {
+		lw.rl.lc.line(lw.rl, lw.stream, string(lw.buf))
+		lw.buf = nil
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestLogCapture(t *testing.T) {
+
+	var out bytes.Buffer
+	lc := newLogCapture()
+	lc.size = 3
+	lc.prefix = true
+	lc.exclude = regexp.MustCompile(`^debug`)
+	lc.stdout, lc.stderr = &out, &out
+
+	rl := lc.start(&target{name: "server"}, 1)
+	fmt.Fprint(rl.stdout, "one\ndebug two\nthr")
+	fmt.Fprint(rl.stdout, "ee\r\nfour")
+	fmt.Fprint(rl.stderr, "oops\n")
+	rl.close()
+
+	want := "[server] one\n[server] three\n[server] oops\n[server] four\n"
+	if out.String() != want {
+		t.Errorf("unexpected output %q, want %q", out.String(), want)
+	}
+
+	var texts []string
+	for _, l := range lc.lines("server") {
+		texts = append(texts, l.Stream+":"+l.Text)
+	}
+	if got := fmt.Sprint(texts); got != "[stdout:three stderr:oops stdout:four]" {
+		t.Errorf("unexpected buffered lines %s", got)
+	}
+
+}
+
+func TestLogFileRotation(t *testing.T) {
+
+	tmpDir, err := ioutil.TempDir("", "TestLogFileRotation")
+	must(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	lc := newLogCapture()
+	lc.dir = tmpDir
+	lc.keep = 2
+
+	// a target whose name starts with the other's keeps its own logs
+	for _, name := range []string{"server-admin", "server-admin", "server", "server", "server"} {
+		f, err := lc.openFile(name, 1)
+		must(t, err)
+		f.Close()
+		time.Sleep(2 * time.Millisecond) // distinct timestamps
+	}
+
+	for pattern, want := range map[string]int{"server-admin-*.log": 2, "server-2*.log": 2} {
+		ps, err := filepath.Glob(filepath.Join(tmpDir, pattern))
+		must(t, err)
+		if len(ps) != want {
+			t.Errorf("%s: got %d files %v, want %d", pattern, len(ps), ps, want)
+		}
+	}
+}
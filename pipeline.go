@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/vugu/vgrun/autoreload"
+)
+
+// Names of the built-in stages.  They can be listed in the config without a
+// cmd to change what they depend on or, for generate, its inputs.
+const (
+	stageGenerate = "generate" // go generate, in the generate dir
+	stageBuild    = "build"    // go build of each affected target
+)
+
+// stageReady is reported as a stage when the new processes fail their ready
+// checks, so it can't be told apart from a failed build otherwise.  It's not
+// part of the pipeline.
+const stageReady = "ready"
+
+// stageConfig is how a pipeline stage is described in the config file.
+type stageConfig struct {
+	Name      string            `json:"name"`
+	Cmd       []string          `json:"cmd"` // program and arguments, ${VAR} is expanded from the environment
+	Dir       string            `json:"dir"` // working dir, default is the dir of the config file
+	Env       map[string]string `json:"env"`
+	Inputs    []string          `json:"inputs"`     // globs as in rules (relative to dir), a change to a match runs the stage
+	Outputs   []string          `json:"outputs"`    // globs of what the stage writes, changes to these don't trigger anything
+	DependsOn []string          `json:"depends-on"` // stages which run first; if any of them runs, so does this one
+}
+
+type stageConfigs []stageConfig
+
+func (scs stageConfigs) resolvePaths(dir string) {
+	for i := range scs {
+		if scs[i].Dir == "" {
+			scs[i].Dir = dir
+		}
+		scs[i].Dir = resolvePath(dir, scs[i].Dir)
+	}
+}
+
+// stage is one step of the pipeline.
+type stage struct {
+	stageConfig
+	root    string   // absolute dir that globs are relative to
+	env     []string // extra environment, as KEY=value
+	deps    []*stage
+	builtin bool
+}
+
+// matches returns true if p matches any of globs.
+func (s *stage) matches(globs []string, p string) bool {
+	for _, g := range globs {
+		if matchGlob(s.root, g, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// stageResult is how a stage went in one pass of the pipeline.
+type stageResult = autoreload.StageResult
+
+// pipeline is the stages run for each change, in the order they run.
+type pipeline struct {
+	stages []*stage
+}
+
+// newPipeline checks the configured stages and puts them in dependency
+// order.  The built-in generate and build stages are added if not configured,
+// by default build depends on generate.  Otherwise stages keep the order they
+// were configured in, with the built-in ones last.
+func newPipeline(scs []stageConfig) (*pipeline, error) {
+
+	byName := make(map[string]*stage)
+	var all []*stage
+
+	for _, sc := range scs {
+		if sc.Name == "" {
+			return nil, fmt.Errorf("stage has no name")
+		}
+		if byName[sc.Name] != nil {
+			return nil, fmt.Errorf("duplicate stage name %q", sc.Name)
+		}
+		if sc.Name == stageReady {
+			return nil, fmt.Errorf("stage name %q is reserved", sc.Name)
+		}
+		s := &stage{stageConfig: sc, env: envList(sc.Env)}
+		s.builtin = sc.Name == stageGenerate || sc.Name == stageBuild
+		switch {
+		case s.builtin && len(sc.Cmd) > 0:
+			return nil, fmt.Errorf("stage %q is built in and can't have a cmd", sc.Name)
+		case s.builtin && sc.Name == stageBuild && len(sc.Inputs) > 0:
+			return nil, fmt.Errorf("stage %q takes its inputs from the targets", sc.Name)
+		case !s.builtin && len(sc.Cmd) == 0:
+			return nil, fmt.Errorf("stage %q has no cmd", sc.Name)
+		}
+		byName[sc.Name] = s
+		all = append(all, s)
+	}
+
+	if byName[stageGenerate] == nil {
+		s := &stage{stageConfig: stageConfig{Name: stageGenerate}, builtin: true}
+		byName[stageGenerate] = s
+		all = append(all, s)
+	}
+	if byName[stageBuild] == nil {
+		s := &stage{stageConfig: stageConfig{Name: stageBuild, DependsOn: []string{stageGenerate}}, builtin: true}
+		byName[stageBuild] = s
+		all = append(all, s)
+	}
+
+	for _, s := range all {
+		root := s.Dir
+		if root == "" {
+			root = "."
+		}
+		var err error
+		s.root, err = filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range s.DependsOn {
+			ds := byName[d]
+			if ds == nil {
+				return nil, fmt.Errorf("stage %q depends on unknown stage %q", s.Name, d)
+			}
+			s.deps = append(s.deps, ds)
+		}
+	}
+
+	// depth first, which keeps the configured order where it can
+	p := &pipeline{}
+	state := make(map[*stage]int) // 1 visiting, 2 done
+	var visit func(s *stage) error
+	visit = func(s *stage) error {
+		switch state[s] {
+		case 1:
+			return fmt.Errorf("stage %q depends on itself", s.Name)
+		case 2:
+			return nil
+		}
+		state[s] = 1
+		for _, d := range s.deps {
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		state[s] = 2
+		p.stages = append(p.stages, s)
+		return nil
+	}
+	for _, s := range all {
+		if err := visit(s); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// isInput returns true if p is an input of any stage.
+func (p *pipeline) isInput(path string) bool {
+	for _, s := range p.stages {
+		if s.matches(s.Inputs, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// isOutput returns true if p is written by any stage.
+func (p *pipeline) isOutput(path string) bool {
+	for _, s := range p.stages {
+		if s.matches(s.Outputs, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// runCmd runs the command of a stage which isn't built in.
+func (s *stage) runCmd(ctx context.Context) error {
+	args := make([]string, len(s.Cmd))
+	for i, a := range s.Cmd {
+		args[i] = os.ExpandEnv(a)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = s.Dir
+	if len(s.env) > 0 {
+		cmd.Env = append(os.Environ(), s.env...)
+	}
+	if *flagV {
+		log.Printf("About to execute stage %s: %v (dir=%v)", s.Name, cmd.Args, cmd.Dir)
+	}
+	b, err := combinedOutputContext(ctx, cmd)
+	if err != nil {
+		return newBuildError(s.Name, "", s.Dir, err, b)
+	}
+	if *flagV && len(b) > 0 {
+		log.Printf("Stage %s output:\n%s", s.Name, b)
+	}
+	return nil
+}
+
+// runPipeline runs each stage of the pipeline which is needed for req: stages
+// with a changed input, generate if req asks for it, build if there are
+// targets to build, and any stage depending on one of those which ran.  If
+// req doesn't say what changed, everything runs.  It returns the targets
+// which built successfully and how each stage went; the error is non-nil if
+// any stage failed.
+func (ru *runner) runPipeline(ctx context.Context, targets []*target, req runStateChangeReq) (built []builtTarget, results []stageResult, reterr error) {
+
+	if *flagV {
+		log.Printf("Running pipeline")
+		defer func() {
+			log.Printf("Exiting pipeline (err=%v)", reterr)
+		}()
+	}
+
+	all := req.unknown()
+	ran := make(map[*stage]bool)
+	failed := make(map[*stage]bool)
+	var errs buildErrors
+	var generateDirs []string
+
+	for _, s := range ru.pipeline.stages {
+
+		if ctx.Err() != nil {
+			return built, results, ctx.Err()
+		}
+
+		// a dependency which ran (or tried to) means this runs too
+		depRan, depFailed := false, false
+		for _, d := range s.deps {
+			depRan = depRan || ran[d] || failed[d]
+			depFailed = depFailed || failed[d]
+		}
+		run := all || depRan
+		switch {
+		case s.Name == stageGenerate:
+			run = (run || req.generate || s.anyMatch(s.Inputs, req.inputs)) && (len(ru.generateDirs) > 0 || ru.generateAuto)
+			if run {
+				// only the dirs with changes, unless something else asked for it
+				generateDirs = ru.generateDirsFor(req, all || depRan || s.anyMatch(s.Inputs, req.inputs))
+				run = len(generateDirs) > 0
+			}
+		case s.Name == stageBuild:
+			if run && len(targets) == 0 { // something it depends on changed, build everything
+				targets = ru.targets
+			}
+			run = len(targets) > 0
+		default:
+			run = run || s.anyMatch(s.Inputs, req.inputs)
+		}
+		if !run {
+			continue
+		}
+		if depFailed {
+			failed[s] = true
+			results = append(results, stageResult{Name: s.Name, Status: "skipped"})
+			continue
+		}
+
+		start := time.Now()
+		var err error
+		switch s.Name {
+		case stageGenerate:
+			err = ru.generate(ctx, generateDirs)
+		case stageBuild:
+			built, err = ru.buildTargets(ctx, targets)
+		default:
+			err = s.runCmd(ctx)
+		}
+		if ctx.Err() != nil {
+			return built, results, ctx.Err()
+		}
+
+		res := stageResult{Name: s.Name, Status: "ok", Duration: time.Since(start).Seconds()}
+		if err != nil {
+			res.Status = "failed"
+			res.Error = err.Error()
+			failed[s] = true
+			switch e := err.(type) {
+			case buildErrors:
+				errs = append(errs, e...)
+			case *buildError:
+				errs = append(errs, e)
+			default:
+				errs = append(errs, newBuildError(s.Name, "", "", err, nil))
+			}
+		} else {
+			ran[s] = true
+		}
+		if *flagV {
+			log.Printf("Stage %s %s in %.2fs", s.Name, res.Status, res.Duration)
+		}
+		results = append(results, res)
+	}
+
+	if len(errs) > 0 {
+		return built, results, errs
+	}
+	return built, results, nil
+}
+
+// anyMatch returns true if any of paths matches any of globs.
+func (s *stage) anyMatch(globs []string, paths []string) bool {
+	for _, p := range paths {
+		if s.matches(globs, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestPipeline(t *testing.T) {
+
+	cmd := []string{"go", "version"}
+	p, err := newPipeline([]stageConfig{
+		{Name: "fingerprint", Cmd: cmd, DependsOn: []string{"tailwind", "build"}},
+		{Name: "tailwind", Cmd: cmd, Inputs: []string{"*.css"}, Outputs: []string{"static/*.css"}},
+		{Name: "protobuf", Cmd: cmd, Inputs: []string{"*.proto"}},
+		{Name: stageBuild, DependsOn: []string{stageGenerate, "protobuf"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, s := range p.stages {
+		names = append(names, s.Name)
+	}
+	want := "[tailwind generate protobuf build fingerprint]"
+	if got := fmt.Sprint(names); got != want {
+		t.Errorf("unexpected order %s, want %s", got, want)
+	}
+
+	if !p.isInput("/x/app.css") || p.isInput("/x/app.go") {
+		t.Errorf("isInput wrong")
+	}
+
+	// only the changed input's stage and what depends on it run
+	ru := &runner{pipeline: p}
+	_, results, err := ru.runPipeline(context.Background(), nil, runStateChangeReq{inputs: []string{"/x/app.css"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ran []string
+	for _, r := range results {
+		ran = append(ran, r.Name+":"+r.Status)
+	}
+	if got := fmt.Sprint(ran); got != "[tailwind:ok fingerprint:ok]" {
+		t.Errorf("unexpected stages run %s", got)
+	}
+
+	// a failing stage skips what depends on it
+	p.stages[0].Cmd = []string{"go", "no-such-command"}
+	_, results, err = ru.runPipeline(context.Background(), nil, runStateChangeReq{inputs: []string{"/x/app.css"}})
+	if err == nil || len(results) != 2 || results[0].Status != "failed" || results[1].Status != "skipped" {
+		t.Errorf("unexpected results %+v (err=%v)", results, err)
+	}
+
+	_, err = newPipeline([]stageConfig{{Name: "a", Cmd: cmd, DependsOn: []string{"b"}}, {Name: "b", Cmd: cmd, DependsOn: []string{"a"}}})
+	if err == nil {
+		t.Errorf("expected error for dependency cycle")
+	}
+	_, err = newPipeline([]stageConfig{{Name: stageReady, Cmd: cmd}})
+	if err == nil {
+		t.Errorf("expected error for reserved stage name")
+	}
+
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+)
+
+// combinedOutputContext is like cmd.CombinedOutput but runs cmd in its own
+// process group and kills the whole group if ctx is done first, so children
+// of cmd (e.g. the compiler and linker started by `go build`) go too.
+func combinedOutputContext(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+	cmd.Stderr = &buf
+	setProcessGroup(cmd)
+
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	waitCh := make(chan error, 1)
+	go func() {
+		waitCh <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-waitCh:
+		return buf.Bytes(), err
+	case <-ctx.Done():
+		kerr := killProcessGroup(cmd)
+		if kerr != nil {
+			log.Printf("Error killing process group of %v: %v", cmd.Args, kerr)
+		}
+		<-waitCh
+		return buf.Bytes(), fmt.Errorf("%v canceled: %w", cmd.Args[:2], ctx.Err())
+	}
+
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// setProcessGroup makes cmd start in a new process group of its own.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// killProcessGroup kills the started cmd and its children.  Windows has no
+// direct equivalent of signalling a process group so taskkill does the work.
+func killProcessGroup(cmd *exec.Cmd) error {
+	err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+	if err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
+
+// stopSignals are the signals which can be used to stop a process.  Windows
+// only has kill, everything else becomes a CTRL_BREAK_EVENT, which Go
+// programs see as os.Interrupt.
+var stopSignals = map[string]os.Signal{
+	"SIGINT":   os.Interrupt,
+	"SIGTERM":  os.Interrupt,
+	"SIGHUP":   os.Interrupt,
+	"SIGQUIT":  os.Interrupt,
+	"SIGBREAK": os.Interrupt,
+	"SIGKILL":  os.Kill,
+}
+
+var procGenerateConsoleCtrlEvent = syscall.NewLazyDLL("kernel32.dll").NewProc("GenerateConsoleCtrlEvent")
+
+// signalProcessGroup sends sig to the process group of the started cmd, which
+// must have been started with setProcessGroup.
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) error {
+	if sig == os.Kill {
+		return killProcessGroup(cmd)
+	}
+	const ctrlBreakEvent = 1
+	r, _, err := procGenerateConsoleCtrlEvent.Call(ctrlBreakEvent, uintptr(cmd.Process.Pid))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readyConfig describes how to tell that a freshly started process is ready
+// to serve, before browsers are told to reload.  At most one check may be set.
+type readyConfig struct {
+	HTTP     string   `json:"http,omitempty"`     // GET this URL until it returns 2xx
+	TCP      string   `json:"tcp,omitempty"`      // connect to this address until it succeeds
+	Stdout   string   `json:"stdout,omitempty"`   // wait for a line of output containing this
+	Notify   bool     `json:"notify,omitempty"`   // wait for READY=1 on $NOTIFY_SOCKET (sd_notify)
+	Timeout  duration `json:"timeout,omitempty"`  // give up after this long, default 30s
+	Interval duration `json:"interval,omitempty"` // time between http and tcp attempts, default 100ms
+}
+
+// defaultReadyDelay is how long we wait for processes with no ready check,
+// to give them a moment to start listening.
+const defaultReadyDelay = 200 * time.Millisecond
+
+func (rc *readyConfig) check() error {
+	n := 0
+	for _, set := range []bool{rc.HTTP != "", rc.TCP != "", rc.Stdout != "", rc.Notify} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return fmt.Errorf("ready must have exactly one of http, tcp, stdout or notify")
+	}
+	return nil
+}
+
+func (rc *readyConfig) timeout() time.Duration {
+	if rc.Timeout > 0 {
+		return time.Duration(rc.Timeout)
+	}
+	return 30 * time.Second
+}
+
+func (rc *readyConfig) interval() time.Duration {
+	if rc.Interval > 0 {
+		return time.Duration(rc.Interval)
+	}
+	return 100 * time.Millisecond
+}
+
+// readiness is the per-process state needed to run a ready check,
+// set up by the runner before the process starts.
+type readiness struct {
+	cfg     *readyConfig
+	readyCh chan struct{} // closed when the stdout marker or READY=1 is seen
+	once    sync.Once
+	exitCh  chan struct{} // closed when the process exits
+	exit    sync.Once
+	closer  io.Closer // notify socket, if any
+}
+
+func newReadiness(cfg *readyConfig) *readiness {
+	return &readiness{cfg: cfg, readyCh: make(chan struct{}), exitCh: make(chan struct{})}
+}
+
+// markReady is called when the process signals it is ready.
+func (r *readiness) markReady() {
+	r.once.Do(func() { close(r.readyCh) })
+}
+
+// close is called once the process has exited, it fails any wait in
+// progress and releases anything held for the check.
+func (r *readiness) close() {
+	r.exit.Do(func() {
+		close(r.exitCh)
+		if r.closer != nil {
+			r.closer.Close()
+		}
+	})
+}
+
+// wait blocks until the check passes, the timeout is hit or ctx is done.
+func (r *readiness) wait(ctx context.Context) error {
+
+	if r.cfg == nil {
+		select {
+		case <-time.After(defaultReadyDelay):
+			return nil
+		case <-r.exitCh:
+			return errExitedBeforeReady
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	timeout := r.cfg.timeout()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var lastErr error
+	var try func() error
+
+	switch {
+
+	case r.cfg.HTTP != "":
+		client := &http.Client{Timeout: 2 * time.Second}
+		try = func() error {
+			req, err := http.NewRequest("GET", r.cfg.HTTP, nil)
+			if err != nil {
+				return err
+			}
+			res, err := client.Do(req.WithContext(ctx))
+			if err != nil {
+				return err
+			}
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+			if res.StatusCode < 200 || res.StatusCode > 299 {
+				return fmt.Errorf("GET %s: %s", r.cfg.HTTP, res.Status)
+			}
+			return nil
+		}
+
+	case r.cfg.TCP != "":
+		try = func() error {
+			var d net.Dialer
+			c, err := d.DialContext(ctx, "tcp", r.cfg.TCP)
+			if err != nil {
+				return err
+			}
+			c.Close()
+			return nil
+		}
+
+	default: // stdout or notify, the process tells us
+		select {
+		case <-r.readyCh:
+			return nil
+		case <-r.exitCh:
+			return errExitedBeforeReady
+		case <-ctx.Done():
+			return readyErr(ctx, timeout, nil)
+		}
+
+	}
+
+	for {
+		lastErr = try()
+		if lastErr == nil {
+			return nil
+		}
+		select {
+		case <-time.After(r.cfg.interval()):
+		case <-r.exitCh:
+			return errExitedBeforeReady
+		case <-ctx.Done():
+			return readyErr(ctx, timeout, lastErr)
+		}
+	}
+
+}
+
+var errExitedBeforeReady = errors.New("process exited before it was ready")
+
+func readyErr(ctx context.Context, timeout time.Duration, lastErr error) error {
+	if ctx.Err() != context.DeadlineExceeded {
+		return fmt.Errorf("ready check abandoned, process was replaced")
+	}
+	if lastErr != nil {
+		return fmt.Errorf("not ready after %v: %w", timeout, lastErr)
+	}
+	return fmt.Errorf("not ready after %v", timeout)
+}
+
+// markerWriter passes writes through to w and calls found the first
+// time a line containing marker is written.
+type markerWriter struct {
+	w      io.Writer
+	marker []byte
+	found  func()
+
+	mu   sync.Mutex
+	line []byte // partial line from prior writes
+	done bool
+}
+
+func (mw *markerWriter) Write(p []byte) (int, error) {
+	mw.mu.Lock()
+	if !mw.done {
+		mw.line = append(mw.line, p...)
+		if bytes.Contains(mw.line, mw.marker) {
+			mw.done = true
+			mw.found()
+		} else if i := bytes.LastIndexByte(mw.line, '\n'); i >= 0 {
+			mw.line = mw.line[i+1:] // only the partial line matters now
+		}
+		if mw.done || len(mw.line) > 64*1024 { // don't hang on to very long lines
+			mw.line = nil
+		}
+	}
+	mw.mu.Unlock()
+	return mw.w.Write(p)
+}
+
+// closerFunc adapts a function to io.Closer.
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
@@ -0,0 +1,52 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// listenNotify creates a socket for the process to send sd_notify style
+// messages to and returns its path, to be passed as NOTIFY_SOCKET.
+// r is marked ready when READY=1 is received.
+func listenNotify(r *readiness) (string, error) {
+
+	dir, err := ioutil.TempDir("", "vgrun-notify")
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(dir, "notify.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: p, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	r.closer = closerFunc(func() error {
+		err := conn.Close()
+		os.RemoveAll(dir)
+		return err
+	})
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return // closed
+			}
+			for _, line := range bytes.Split(buf[:n], []byte("\n")) {
+				if string(line) == "READY=1" {
+					r.markReady()
+				}
+			}
+		}
+	}()
+
+	return p, nil
+}
@@ -0,0 +1,8 @@
+package main
+
+import "fmt"
+
+// listenNotify is not supported on Windows, which has no unixgram sockets.
+func listenNotify(r *readiness) (string, error) {
+	return "", fmt.Errorf("notify ready check is not supported on Windows")
+}
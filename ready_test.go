@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+
+	// http check keeps trying until it gets a 2xx
+	var n int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&n, 1) < 3 {
+			w.WriteHeader(503)
+		}
+	}))
+	defer srv.Close()
+
+	r := newReadiness(&readyConfig{HTTP: srv.URL, Interval: duration(10 * time.Millisecond)})
+	if err := r.wait(context.Background()); err != nil {
+		t.Errorf("http check: %v", err)
+	}
+	if atomic.LoadInt32(&n) != 3 {
+		t.Errorf("expected 3 requests, got %d", n)
+	}
+
+	// and fails once the timeout is hit
+	r = newReadiness(&readyConfig{TCP: "127.0.0.1:1", Timeout: duration(100 * time.Millisecond)})
+	if err := r.wait(context.Background()); err == nil {
+		t.Errorf("tcp check should have timed out")
+	}
+
+	// stdout marker split across writes
+	r = newReadiness(&readyConfig{Stdout: "listening on"})
+	var out bytes.Buffer
+	mw := &markerWriter{w: &out, marker: []byte("listening on"), found: r.markReady}
+	mw.Write([]byte("starting\nlisten"))
+	mw.Write([]byte("ing on :8844\n"))
+	if err := r.wait(context.Background()); err != nil {
+		t.Errorf("stdout check: %v", err)
+	}
+	if out.String() != "starting\nlistening on :8844\n" {
+		t.Errorf("output not passed through: %q", out.String())
+	}
+
+	// a process exiting fails the check straight away
+	r = newReadiness(&readyConfig{Stdout: "never"})
+	r.close()
+	if err := r.wait(context.Background()); err != errExitedBeforeReady {
+		t.Errorf("expected errExitedBeforeReady, got %v", err)
+	}
+
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// restartPolicy says what happens when a process exits without us stopping it.
+type restartPolicy string
+
+const (
+	restartExit          = restartPolicy("exit")            // stop everything and exit vgrun
+	restartWaitForChange = restartPolicy("wait-for-change") // keep watching, rebuild and start it on the next change
+	restartAlways        = restartPolicy("always")          // start it again after a backoff delay
+)
+
+func (p restartPolicy) check() error {
+	switch p {
+	case restartExit, restartWaitForChange, restartAlways:
+		return nil
+	}
+	return fmt.Errorf("unknown restart policy %q (must be exit, wait-for-change or always)", p)
+}
+
+const (
+	restartBackoffMin  = 500 * time.Millisecond // delay before the first restart
+	restartBackoffMax  = 30 * time.Second       // delay never grows beyond this
+	restartStableAfter = 10 * time.Second       // a process running this long resets the backoff
+	restartCrashLoop   = 5                      // this many quick exits in a row is a crash loop
+)
+
+// restartState tracks recent exits of a target to work out the backoff.
+type restartState struct {
+	quickExits int // consecutive exits which happened before restartStableAfter
+	seq        int // identifies the current process generation, bumped by reset so restarts scheduled before it are ignored
+}
+
+// exited records that a process which started at startedAt has exited and returns
+// how long to wait before starting it again.  crashLoop is true if it keeps
+// exiting quickly and should not be restarted until something changes.
+func (rs *restartState) exited(startedAt time.Time) (delay time.Duration, crashLoop bool) {
+
+	if time.Since(startedAt) >= restartStableAfter {
+		rs.quickExits = 0
+	}
+	rs.quickExits++
+
+	if rs.quickExits >= restartCrashLoop {
+		return 0, true
+	}
+
+	delay = restartBackoffMin << uint(rs.quickExits-1)
+	if delay > restartBackoffMax {
+		delay = restartBackoffMax
+	}
+	return delay, false
+}
+
+// reset forgets prior exits, e.g. after a rebuild.
+func (rs *restartState) reset() {
+	rs.quickExits = 0
+	rs.seq++
+}
+
+// scheduledRestart is sent on the runner's restartCh once a backoff delay is
+// over.  seq is the generation it was scheduled in.
+type scheduledRestart struct {
+	t   *target
+	seq int
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// changeAction is what to do when a watched file changes.  Actions are ordered
+// so that when several files change at once the greatest one wins.
+type changeAction int
+
+const (
+	actionIgnore     = changeAction(iota) // do nothing
+	actionCSS                             // swap stylesheets in the browser without a reload
+	actionReload                          // reload the browser only
+	actionRestart                         // restart processes without a rebuild
+	actionRebuild                         // go build and restart
+	actionRegenerate                      // go generate, go build and restart
+)
+
+var changeActionNames = map[changeAction]string{
+	actionIgnore:     "ignore",
+	actionCSS:        "css",
+	actionReload:     "reload",
+	actionRestart:    "restart",
+	actionRebuild:    "rebuild",
+	actionRegenerate: "regenerate",
+}
+
+func (a changeAction) String() string {
+	if s, ok := changeActionNames[a]; ok {
+		return s
+	}
+	return fmt.Sprintf("changeAction(%d)", int(a))
+}
+
+func (a changeAction) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+func (a *changeAction) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	for k, v := range changeActionNames {
+		if v == s {
+			*a = k
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown action %q", s)
+}
+
+// changeRule maps files matching either a regexp pattern (against the full path)
+// or a glob (against the file name, or the slash separated path relative to the
+// watch dir if the glob contains a slash) to an action.
+type changeRule struct {
+	Pattern string       `json:"pattern,omitempty"`
+	Glob    string       `json:"glob,omitempty"`
+	Action  changeAction `json:"action"`
+
+	re *regexp.Regexp
+}
+
+type changeRules []changeRule
+
+// defaultChangeRules come after the rules from the config, so the common file
+// types do the right thing without any rules but can be overridden by them.
+// A config rule {"glob": "*", "action": "ignore"} turns them off.
+var defaultChangeRules = changeRules{
+	{Glob: "*_vgen.go", Action: actionIgnore}, // written by vugugen during generate
+	{Glob: "*.vugu", Action: actionRegenerate},
+	{Glob: "*.go", Action: actionRebuild},
+	{Glob: "*.html", Action: actionReload},
+	{Glob: "*.js", Action: actionReload},
+	{Glob: "*.css", Action: actionCSS},
+}
+
+// changeClassifier decides the action for a changed file.  The first
+// rule which matches wins, files matching no rule are ignored.
+type changeClassifier struct {
+	root  string // absolute watch dir, globs with a slash are relative to this
+	rules []changeRule
+}
+
+// newChangeClassifier compiles rules for use on files under root.
+func newChangeClassifier(root string, rules []changeRule) (*changeClassifier, error) {
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &changeClassifier{root: absRoot}
+	for _, r := range rules {
+		switch {
+		case r.Pattern != "" && r.Glob != "":
+			return nil, fmt.Errorf("rule has both pattern %q and glob %q", r.Pattern, r.Glob)
+		case r.Pattern != "":
+			r.re, err = regexp.Compile(r.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule pattern %q: %w", r.Pattern, err)
+			}
+		case r.Glob != "":
+			_, err = path.Match(r.Glob, "")
+			if err != nil {
+				return nil, fmt.Errorf("rule glob %q: %w", r.Glob, err)
+			}
+		default:
+			return nil, fmt.Errorf("rule for action %v must have a pattern or a glob", r.Action)
+		}
+		cc.rules = append(cc.rules, r)
+	}
+
+	return cc, nil
+}
+
+// classify returns the action for a change to p.
+func (cc *changeClassifier) classify(p string) changeAction {
+	for _, r := range cc.rules {
+		if r.matches(cc.root, p) {
+			return r.Action
+		}
+	}
+	return actionIgnore
+}
+
+func (r *changeRule) matches(root, p string) bool {
+	if r.re != nil {
+		return r.re.MatchString(p)
+	}
+	return matchGlob(root, r.Glob, p)
+}
+
+// matchGlob matches p against glob, which is matched against the file name,
+// or the slash separated path relative to root if the glob contains a slash.
+func matchGlob(root, glob, p string) bool {
+
+	name := filepath.Base(p)
+	if strings.Contains(glob, "/") {
+		absPath, err := filepath.Abs(p)
+		if err != nil {
+			return false
+		}
+		rel, err := filepath.Rel(root, absPath)
+		if err != nil {
+			return false
+		}
+		name = filepath.ToSlash(rel)
+	}
+
+	ok, _ := path.Match(glob, name)
+	return ok
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func TestChangeClassifier(t *testing.T) {
+
+	var rules changeRules
+	err := json.Unmarshal([]byte(`[
+		{"glob": "*_vgen.go", "action": "ignore"},
+		{"pattern": "\\.vugu$", "action": "regenerate"},
+		{"glob": "*.go", "action": "rebuild"},
+		{"glob": "static/*.html", "action": "reload"},
+		{"glob": "*.js", "action": "reload"},
+		{"glob": "*.css", "action": "css"}
+	]`), &rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := filepath.Abs("testdata-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := newChangeClassifier(root, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]changeAction{
+		"root_vgen.go":         actionIgnore,
+		"pages/index.vugu":     actionRegenerate,
+		"server/main.go":       actionRebuild,
+		"static/index.html":    actionReload,
+		"other/index.html":     actionIgnore,
+		"static/js/app.js":     actionReload,
+		"static/css/style.css": actionCSS,
+		"README.md":            actionIgnore,
+	} {
+		got := cc.classify(filepath.Join(root, filepath.FromSlash(path)))
+		if got != want {
+			t.Errorf("classify(%q) = %v, want %v", path, got, want)
+		}
+	}
+
+	// the defaults, after a config rule overriding one of them
+	cc, err = newChangeClassifier(root, append(changeRules{{Glob: "static/*.js", Action: actionIgnore}}, defaultChangeRules...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]changeAction{
+		"pages/index.vugu":           actionRegenerate,
+		"pages/0_components_vgen.go": actionIgnore,
+		"server/main.go":             actionRebuild,
+		"index.html":                 actionReload,
+		"js/app.js":                  actionReload,
+		"static/app.js":              actionIgnore,
+		"static/css/style.css":       actionCSS,
+		"README.md":                  actionIgnore,
+	} {
+		got := cc.classify(filepath.Join(root, filepath.FromSlash(path)))
+		if got != want {
+			t.Errorf("classify(%q) with defaults = %v, want %v", path, got, want)
+		}
+	}
+
+	_, err = newChangeClassifier(root, changeRules{{Action: actionReload}})
+	if err == nil {
+		t.Errorf("expected error for rule without pattern or glob")
+	}
+
+	var a changeAction
+	if err := json.Unmarshal([]byte(`"explode"`), &a); err == nil {
+		t.Errorf("expected error for unknown action")
+	}
+}
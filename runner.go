@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -8,6 +9,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,26 +19,60 @@ import (
 */
 
 type runner struct {
-	generateDir string   // run go generate in this folder, empty means disable, "." means cur dir
-	binDir      string   // where to write output files
-	buildTarget string   // either "filename.go" or e.g. "server" which is dir name of main pkg
-	args        []string // cmdline args to be passed when running
+	generateDirs     []string  // run go generate in these folders, empty means disable
+	generateAuto     bool      // instead of generateDirs, use every folder with a //go:generate
+	generateParallel int       // how many go generates to run at once, 0 means one per CPU
+	binDir           string    // where to write output files
+	targets          []*target // programs to build and run, all share the one go generate
+
+	cancelStaleBuilds bool // kill an in-progress build when newer changes arrive
 	// rwmu        sync.RWMutex
 	// looping     bool      // false when stop() is called
-	cmd *exec.Cmd // actively running command
 
 	// pid              int                 // pid of the currently running process or 0 if not running
 	runState            runState               // current state
 	runStateUpdateCh    chan runState          // state changes are sent here
 	runStateChangeReqCh chan runStateChangeReq // request state changes with this
 
+	exitCh    chan targetExit       // processes exiting, whether by themselves or because we stopped them
+	restartCh chan scheduledRestart // processes to start again after exiting by themselves
+
+	readyCh     chan readyResult   // results of announce
+	readyCancel context.CancelFunc // abandons the current announce, if any
+	readySeq    int                // identifies the current announce
+	announcing  []*target          // targets the current announce is waiting on
+	announceCyc *cycleTimings      // cycle the current announce finishes, nil if none
+
+	pipeline *pipeline // stages run for each change
+
+	pendingMu sync.Mutex
+	pending   *runStateChangeReq // changes not yet built, nil when the tree is clean
+	pendingCh chan struct{}      // signals the run loop that pending was updated
+
 	setPider setPider
+	reloader browserReloader
+
+	buildReporters []buildReporter // told the result of every build
+
+	lastBuildMu sync.Mutex
+	lastBuild   *buildReport
+
+	timings *timingHistory // timings of recent rebuild cycles
+	logs    *logCapture    // output of the processes
+
+	procsMu sync.Mutex
+	procs   map[*exec.Cmd]bool // every process started which hasn't exited, for killAll
 }
 
 type setPider interface {
 	setPid(pid int)
 }
 
+// browserReloader is told when browsers should reload without a new process having started
+type browserReloader interface {
+	reload()
+}
+
 type runState int
 
 const (
@@ -49,17 +85,94 @@ const (
 )
 
 // run state change request
-type runStateChangeReq int
+type runStateChangeReq struct {
+	kind     runStateChangeReqKind
+	changes  []string  // paths whose change caused this request, empty (with no inputs) means unknown and everything is rebuilt
+	inputs   []string  // changed inputs of pipeline stages
+	restarts []string  // changed env files, the targets using them restart even if their binary doesn't change
+	generate bool      // run go generate before building
+	trigger  time.Time // when the changes were seen, zero if unknown
+}
+
+// unknown returns true if r doesn't say what changed.
+func (r runStateChangeReq) unknown() bool {
+	return len(r.changes) == 0 && len(r.inputs) == 0
+}
+
+type runStateChangeReqKind int
 
 const (
-	runStateChangeReqStop = runStateChangeReq(iota)
+	runStateChangeReqStop = runStateChangeReqKind(iota)
 	runStateChangeReqRebuildAndRestart
+	runStateChangeReqRestart // restart processes without rebuilding, e.g. an env file changed
 )
 
+// merge returns a request covering the changes of both r and o.
+func (r runStateChangeReq) merge(o runStateChangeReq) runStateChangeReq {
+	ret := runStateChangeReq{
+		kind:     r.kind,
+		generate: r.generate || o.generate,
+		trigger:  r.trigger,
+		restarts: mergePaths(r.restarts, o.restarts),
+	}
+	if ret.trigger.IsZero() || (!o.trigger.IsZero() && o.trigger.Before(ret.trigger)) {
+		ret.trigger = o.trigger // the earliest
+	}
+	if r.unknown() || o.unknown() {
+		return ret // either one is unknown, so is the result
+	}
+	ret.changes = mergePaths(r.changes, o.changes)
+	ret.inputs = mergePaths(r.inputs, o.inputs)
+	return ret
+}
+
+// mergePaths returns the paths in a or b, without duplicates.
+func mergePaths(a, b []string) []string {
+	var ret []string
+	seen := make(map[string]bool, len(a)+len(b))
+	for _, c := range append(append([]string(nil), a...), b...) {
+		if !seen[c] {
+			seen[c] = true
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// buildResult is the outcome of runPipeline running in the background
+type buildResult struct {
+	targets  []*target     // what was asked to be built
+	built    []builtTarget // what was built successfully
+	stages   []stageResult
+	err      error
+	canceled bool          // a newer request came along, the result should be discarded
+	cycle    *cycleTimings // timings so far
+}
+
+// builtTarget is a target which built successfully, along with the
+// identity of the binary it produced (see target.binaryID).
+type builtTarget struct {
+	t     *target
+	binID string
+}
+
+// targetExit is sent on exitCh when a process started for t exits
+type targetExit struct {
+	t   *target
+	cmd *exec.Cmd
+}
+
 func newRunner() *runner {
 	return &runner{
 		runStateUpdateCh:    make(chan runState, 32),
 		runStateChangeReqCh: make(chan runStateChangeReq, 1),
+		exitCh:              make(chan targetExit, 32),
+		restartCh:           make(chan scheduledRestart, 32),
+		readyCh:             make(chan readyResult, 1),
+		pendingCh:           make(chan struct{}, 1),
+		timings:             &timingHistory{size: 100},
+		logs:                newLogCapture(),
+		procs:               make(map[*exec.Cmd]bool),
 	}
 }
 
@@ -75,167 +188,823 @@ func (ru *runner) run() error {
 		return fmt.Errorf("unexpected start state: %v", ru.runState)
 	}
 
+	if len(ru.targets) == 0 {
+		return fmt.Errorf("no targets to run")
+	}
+
 	defer func() {
-		ru.runState = runStateNone
-		select { // non-blocking send
-		case ru.runStateUpdateCh <- ru.runState:
-		default:
-		}
+		ru.setRunState(runStateNone)
+	}()
 
+	// the initial build happens before the loop below, but a stop request
+	// still cancels it
+	initCtx, initCancel := context.WithCancel(context.Background())
+	stoppedCh := make(chan bool, 1)
+	go func() {
+		for {
+			select {
+			case req := <-ru.runStateChangeReqCh:
+				switch req.kind {
+				case runStateChangeReqStop:
+					initCancel()
+					stoppedCh <- true
+					return
+				case runStateChangeReqRebuildAndRestart:
+					ru.addPending(req, true) // built once the loop starts
+				}
+				// a restart is moot, nothing has started yet
+			case <-initCtx.Done():
+				stoppedCh <- false
+				return
+			}
+		}
 	}()
 
-	// keeps track of which command is currently running (if any)
-	var cmd *exec.Cmd
-	// the error returned from Wait() when th process exits
-	var cmdErrCh chan error
+	cycle := newCycle(time.Time{})
+	ru.reportStart(ru.targets)
+	built, stages, err := ru.runPipeline(initCtx, ru.targets, runStateChangeReq{generate: true})
+	initCancel()
+	if <-stoppedCh {
+		return nil
+	}
+	ru.report(ru.targets, stages, err)
+	if err != nil {
+		// on error if process not running, exit
+		return fmt.Errorf("initial build error: %w", err)
+	}
+	ru.setRunState(runStateRebuildSuccess)
 
-	for {
+	cycle.built(ru.targets, stages)
+	err = ru.restart(ru.changedTargets(built), cycle)
+	if err != nil {
+		ru.stopAll()
+		return err
+	}
 
-		err := ru.generateAndBuild()
-		if err != nil {
-			// on error if process not running, exit
-			if cmd == nil {
-				return fmt.Errorf("initial build error: %w", err)
+	// the build in progress (if any) runs in its own goroutine so newer
+	// changes can cancel it; buildReq is what it was started for
+	var buildCancel context.CancelFunc
+	var buildReq runStateChangeReq
+	buildDoneCh := make(chan buildResult, 1)
+
+	startBuild := func(req runStateChangeReq) {
+		var affected []*target
+		if len(req.changes) > 0 || req.unknown() {
+			affected = ru.affectedTargets(req.changes)
+		}
+		if len(affected) == 0 && len(req.inputs) == 0 {
+			if *flagV {
+				log.Printf("No targets affected by changes to %v", req.changes)
+			}
+			ru.setRunState(runStateRunning)
+			if len(req.restarts) > 0 {
+				err := ru.restart(ru.restartTargets(req.restarts), newCycle(req.trigger))
+				if err != nil {
+					log.Printf("Restart error: %v", err)
+					ru.setRunState(runStateRebuildFail)
+				}
 			}
-			log.Printf("generate or build failure:\n%v", err)
-			// if process still running but generateAndBuild failed, we skip over the process start
-			// and just wait for events again
+			return
+		}
+		var ctx context.Context
+		ctx, buildCancel = context.WithCancel(context.Background())
+		buildReq = req
+		ru.reportStart(affected)
+		go func() {
+			cycle := newCycle(req.trigger)
+			built, stages, err := ru.runPipeline(ctx, affected, req)
+			buildDoneCh <- buildResult{targets: affected, built: built, stages: stages, err: err, canceled: ctx.Err() != nil, cycle: cycle}
+		}()
+	}
+
+	for {
+
+		select {
+
+		// we've been asked to change the state while running
+		case req := <-ru.runStateChangeReqCh:
+
+			switch req.kind {
+
+			// if they asked us to stop we're done
+			case runStateChangeReqStop:
+				if buildCancel != nil {
+					buildCancel()
+				}
+				ru.stopAll()
+				return nil
+
+			// they asked us to rebuild+restart
+			case runStateChangeReqRebuildAndRestart:
+				ru.addPending(req, true)
+
+			// or just restart, the binaries are the same but their environment isn't
+			case runStateChangeReqRestart:
+				targets := ru.restartTargets(req.changes)
+				log.Printf("Restarting %v", targets)
+				err := ru.restart(targets, newCycle(req.trigger))
+				if err != nil {
+					log.Printf("Restart error: %v", err)
+					ru.setRunState(runStateRebuildFail)
+				}
 
-			ru.runState = runStateRebuildFail
-			select { // non-blocking send
-			case ru.runStateUpdateCh <- ru.runState:
 			default:
-			}
+				panic(fmt.Errorf("unknown state change request: %v", req))
 
-			goto waitForIt
-		}
+			}
 
-		ru.runState = runStateRebuildSuccess
-		select { // non-blocking send
-		case ru.runStateUpdateCh <- ru.runState:
-		default:
-		}
+		// the tree is dirty
+		case <-ru.pendingCh:
 
-		// build was successful, we now need to stop the prior running process if applicable
-		if cmd != nil {
-			if *flagV {
-				log.Printf("about to perform gracefulStop on pid=%v", cmd.Process.Pid)
+			if buildCancel == nil {
+				if req, ok := ru.takePending(); ok {
+					startBuild(req)
+				}
+				continue
 			}
-			gracefulStop(cmd.Process, cmdErrCh, time.Second*10)
-		}
 
-		{
-			// new command, new channel
-			cmd = nil
-			cmdErrCh = make(chan error, 1)
+			// a build is already running and is now stale, cancel it if we're allowed
+			// to, otherwise the pending changes are picked up once it's done
+			if ru.cancelStaleBuilds {
+				if *flagV {
+					log.Printf("Canceling in-progress build, newer changes arrived")
+				}
+				buildCancel()
+			}
 
-			// attempt to run process
-			// if ru.isGoRunTarget() {
-			// 	args := []string{"run", ru.buildTarget}
-			// 	args = append(args, ru.args...)
-			// 	cmd = exec.Command("go", args...)
-			// } else {
-			cmd = exec.Command(filepath.Join(ru.binDir, strings.TrimSuffix(filepath.Base(ru.buildTarget), ".go")+exeSuffix()), ru.args...)
-			// }
-			ru.cmd = cmd
+		case res := <-buildDoneCh:
+			buildCancel()
+			buildCancel = nil
+
+			if res.canceled {
+				// put back what the canceled build was for, it still needs doing
+				log.Printf("Build canceled, rebuilding with latest changes")
+				ru.addPending(buildReq, false)
+				req, _ := ru.takePending()
+				startBuild(req)
+				continue
+			}
 
-			cmd.Stdin = os.Stdin
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
+			br := ru.report(res.targets, res.stages, res.err)
+			res.cycle.built(res.targets, res.stages)
+			if res.err != nil {
+				res.cycle.Outcome = "build-failed"
+				// targets which did build are still restarted below, the rest
+				// keep running their prior process and we wait for events again
+				var sb strings.Builder
+				printBuildReport(&sb, br)
+				log.Print(sb.String())
+			} else {
+				ru.setRunState(runStateRebuildSuccess)
+			}
 
-			err = cmd.Start()
+			changed := ru.changedTargets(res.built)
+			if len(buildReq.restarts) > 0 { // their env changed too, whether or not they were rebuilt
+				changed = mergeTargets(changed, ru.restartTargets(buildReq.restarts))
+			}
+			err := ru.restart(changed, res.cycle)
 			if err != nil {
 				// process start error is always an immediate exit
-				return fmt.Errorf("process start error: %w", err)
+				ru.stopAll()
+				return err
 			}
 
-			ru.runState = runStateRunning
-			select { // non-blocking send
-			case ru.runStateUpdateCh <- ru.runState:
-			default:
+			if res.err != nil {
+				ru.setRunState(runStateRebuildFail)
+			} else if len(changed) == 0 { // only stages ran or the builds were no-ops, nothing to restart
+				ru.setRunState(runStateRunning)
+			}
+			if len(changed) == 0 {
+				ru.finishCycle(res.cycle, "no-op")
 			}
 
-			// whenever we have a new pid, we tell the auto-reloader about it
-			ru.setPider.setPid(cmd.Process.Pid)
-
-			// wait in goroutine (convert blocking call to channel so we can `select` below)
-			go func() {
-				err := cmd.Wait()
-				select { // non-blocking send
-				case cmdErrCh <- err:
-				default:
+			// anything which changed during the build gets exactly one follow-up build
+			if req, ok := ru.takePending(); ok {
+				if len(req.changes) > 0 {
+					log.Printf("%d file(s) changed during the build, rebuilding: %s", len(req.changes), strings.Join(req.changes, ", "))
+				} else {
+					log.Printf("Files changed during the build, rebuilding")
+				}
+				startBuild(req)
+			}
+
+		// a process exited, either on it's own or because we stopped it
+		case ex := <-ru.exitCh:
+			if ex.t.cmd != ex.cmd {
+				continue // one we stopped, gracefulStop already dealt with it
+			}
+			t := ex.t
+			err := <-t.cmdErrCh
+			t.cmd = nil
+
+			// the previous process is still serving, the failed ready check puts it back
+			if t.handoff != nil {
+				log.Printf("Process %s exited (%v) before it was ready", t.name, exitDesc(err))
+				continue
+			}
+
+			switch t.restartPolicy {
+
+			case restartWaitForChange:
+				log.Printf("Process %s exited (%v), waiting for changes before starting it again", t.name, exitDesc(err))
+
+			case restartAlways:
+				delay, crashLoop := t.restartState.exited(t.startedAt)
+				if crashLoop {
+					log.Printf("Process %s exited (%v) and appears to be crash looping, waiting for changes before starting it again", t.name, exitDesc(err))
+					continue
 				}
+				log.Printf("Process %s exited (%v), restarting in %v", t.name, exitDesc(err), delay)
+				sr := scheduledRestart{t: t, seq: t.restartState.seq}
+				time.AfterFunc(delay, func() {
+					ru.restartCh <- sr
+				})
+
+			default: // restartExit
+				// we just exit in this case
+				// if *flagV {
+				// 	log.Printf("Process exited by itself: %v", err)
+				// }
+				if buildCancel != nil {
+					buildCancel()
+				}
+				ru.stopAll()
+				if err != nil {
+					return fmt.Errorf("Unexpected process exit (%s): %w", t.name, err)
+				}
+				return err
+			}
+
+		// a backoff delay is over, start the process again unless something else already has
+		case sr := <-ru.restartCh:
+			t := sr.t
+			if t.cmd != nil || sr.seq != t.restartState.seq {
+				continue
+			}
+			err := ru.start(t)
+			if err != nil {
+				log.Printf("Process start error (%s): %v", t.name, err)
+				continue
+			}
+			// a rebuild's announce may still be waiting, this carries it on
+			ru.announce([]*target{t}, ru.announceCyc)
+
+		// processes are ready (or not), let the browsers know
+		case rr := <-ru.readyCh:
+			if rr.seq != ru.readySeq {
+				continue // superseded by a later announce
+			}
+			ru.readyCancel()
+			ru.readyCancel = nil
+			ru.announcing = nil
+			cycle := ru.announceCyc
+			ru.announceCyc = nil
+
+			// the new processes are serving, the old ones can go; those which
+			// failed to become ready go back to the old ones, if still running
+			stopStart := time.Now()
+			for _, t := range rr.targets {
+				if containsTarget(rr.failed, t) {
+					ru.rollbackHandoff(t)
+				} else {
+					ru.stopHandoff(t)
+				}
+			}
+			if cycle != nil {
+				cycle.Ready = stopStart.Sub(cycle.readyStart).Seconds()
+				cycle.Stop += time.Since(stopStart).Seconds()
+			}
+
+			if rr.err != nil {
+				log.Printf("Ready check failed: %v", rr.err)
+				res := stageResult{Name: stageReady, Status: "failed", Error: rr.err.Error()}
+				if cycle != nil {
+					res.Duration = cycle.Ready
+				}
+				ru.report(rr.targets, []stageResult{res}, rr.err)
+				ru.setRunState(runStateRebuildFail)
+				ru.finishCycle(cycle, "ready-failed")
+				continue
+			}
+
+			ru.setRunState(runStateRunning)
+			ru.finishCycle(cycle, "ok")
+
+			// whenever we have a new pid, we tell the auto-reloader about it
+			if rr.pid != 0 {
+				ru.setPider.setPid(rr.pid)
+			} else {
+				ru.reloader.reload()
+			}
 
-			}()
 		}
+	}
 
-		// TODO: send updates to runStateUpdateCh non-blocking, somewhere...
+	// unreachable
 
-	waitForIt:
-		select {
+}
 
-		// we've been asked to change the state while running
-		case req := <-ru.runStateChangeReqCh:
+// addPending merges req into the pending changes, marking the tree dirty.
+// If kick is true the run loop is woken up to act on it, otherwise it's
+// picked up the next time the loop looks (e.g. once a build finishes).
+// It is safe to call from any goroutine.
+func (ru *runner) addPending(req runStateChangeReq, kick bool) {
+	ru.pendingMu.Lock()
+	if ru.pending == nil {
+		ru.pending = &req
+	} else {
+		*ru.pending = ru.pending.merge(req)
+	}
+	ru.pendingMu.Unlock()
+	if kick {
+		ru.kick()
+	}
+}
 
-			switch req {
+// kick wakes the run loop up to look at the pending changes.
+func (ru *runner) kick() {
+	select { // non-blocking send, one wake up is enough
+	case ru.pendingCh <- struct{}{}:
+	default:
+	}
+}
 
-			// if they asked us to stop we're done
-			case runStateChangeReqStop:
-				gracefulStop(cmd.Process, cmdErrCh, time.Second*10)
-				return nil
+// takePending returns and clears the pending changes, ok is false if the tree is clean.
+func (ru *runner) takePending() (req runStateChangeReq, ok bool) {
+	ru.pendingMu.Lock()
+	defer ru.pendingMu.Unlock()
+	if ru.pending == nil {
+		return req, false
+	}
+	req = *ru.pending
+	ru.pending = nil
+	return req, true
+}
 
-			// they asked us to rebuild+restart
-			case runStateChangeReqRebuildAndRestart:
-				// fall through to top of loop
+// reportStart tells the buildReporters which are buildStarters that a build
+// of targets is starting.
+func (ru *runner) reportStart(targets []*target) {
+	names := make([]string, 0, len(targets))
+	for _, t := range targets {
+		names = append(names, t.name)
+	}
+	for _, r := range ru.buildReporters {
+		if bs, ok := r.(buildStarter); ok {
+			bs.buildStart(names)
+		}
+	}
+}
 
-			default:
-				panic(fmt.Errorf("unknown state change request: %v", req))
+// report records the outcome of building targets as the last build result
+// and sends it to each of the buildReporters.
+func (ru *runner) report(targets []*target, stages []stageResult, err error) *buildReport {
+
+	br := &buildReport{
+		Time:    time.Now(),
+		Success: err == nil,
+		Stages:  stages,
+	}
+	for _, t := range targets {
+		br.Targets = append(br.Targets, t.name)
+	}
+	if es, ok := err.(buildErrors); ok {
+		br.Diagnostics = es.diagnostics()
+		for _, e := range es {
+			br.Errors = append(br.Errors, e.Error())
+		}
+	} else if err != nil {
+		br.Errors = []string{err.Error()}
+	}
+
+	ru.lastBuildMu.Lock()
+	ru.lastBuild = br
+	ru.lastBuildMu.Unlock()
+
+	for _, r := range ru.buildReporters {
+		r.buildReport(br)
+	}
+
+	return br
+}
+
+// lastBuildReport returns the result of the most recent build, nil if none has finished yet.
+func (ru *runner) lastBuildReport() *buildReport {
+	ru.lastBuildMu.Lock()
+	defer ru.lastBuildMu.Unlock()
+	return ru.lastBuild
+}
+
+// exitDesc describes the result of cmd.Wait for log messages.
+func exitDesc(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	return err.Error()
+}
+
+// setRunState updates runState and sends it on runStateUpdateCh without blocking.
+func (ru *runner) setRunState(rs runState) {
+	ru.runState = rs
+	select { // non-blocking send
+	case ru.runStateUpdateCh <- rs:
+	default:
+	}
+}
+
+// affectedTargets returns the targets which need rebuilding after changes to paths.
+func (ru *runner) affectedTargets(paths []string) []*target {
+	var ret []*target
+	for _, t := range ru.targets {
+		// processes which exited by themselves are always included so they start again
+		exited := t.kind == targetKindProcess && t.cmd == nil
+		if exited || t.affectedBy(paths) {
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
+
+// isBuildOutput returns true if p is written by go build for one of the
+// targets, including the temp file it writes first.
+func (ru *runner) isBuildOutput(p string) bool {
+	absp, err := filepath.Abs(p)
+	if err != nil {
+		return false
+	}
+	for _, t := range ru.targets {
+		out, err := filepath.Abs(t.outPath(ru.binDir))
+		if err == nil && (absp == out || strings.HasPrefix(absp, out+"-go-tmp-")) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeTargets returns the targets in a or b, without duplicates.
+func mergeTargets(a, b []*target) []*target {
+	ret := append([]*target(nil), a...)
+	for _, t := range b {
+		dup := false
+		for _, t2 := range a {
+			dup = dup || t == t2
+		}
+		if !dup {
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
 
+// restartTargets returns the process targets to restart after changes to paths:
+// the ones using any of paths as an env file, or all of them if none do.
+func (ru *runner) restartTargets(paths []string) []*target {
+	var all, ret []*target
+	for _, t := range ru.targets {
+		if t.kind == targetKindWasm {
+			continue
+		}
+		all = append(all, t)
+		for _, p := range paths {
+			if t.usesEnvFile(p) {
+				ret = append(ret, t)
+				break
 			}
+		}
+	}
+	if len(ret) == 0 {
+		return all
+	}
+	return ret
+}
+
+// restart stops the prior process (if any) of each target and starts a new one,
+// then tells the auto-reloader about it.  Wasm targets have no process, if only
+// they were rebuilt the browsers are simply told to reload.  The time taken is
+// added to cycle, which is finished once the new processes are ready.
+func (ru *runner) restart(targets []*target, cycle *cycleTimings) error {
+
+	if len(targets) == 0 {
+		return nil
+	}
 
-		// process exited on it's own
-		case err := <-cmdErrCh:
-			// we always just exit in this case
-			// if *flagV {
-			// 	log.Printf("Process exited by itself: %v", err)
-			// }
+	var started []*target
+	for _, t := range targets {
+
+		if t.kind == targetKindWasm {
+			continue
+		}
+
+		// we now need to stop the prior running process if applicable;
+		// with a listener it's kept running until the new one is ready
+		stopStart := time.Now()
+		if t.listen != "" {
+			ru.stopHandoff(t)
+			if t.cmd != nil {
+				t.handoff = &handoff{cmd: t.cmd, cmdErrCh: t.cmdErrCh}
+				t.cmd = nil
+			}
+		} else {
+			ru.stop(t)
+		}
+		t.restartState.reset() // new build, clean slate
+
+		startStart := time.Now()
+		cycle.Stop += startStart.Sub(stopStart).Seconds()
+		err := ru.start(t)
+		cycle.Start += time.Since(startStart).Seconds()
+		if err != nil {
+			return fmt.Errorf("process start error (%s): %w", t.name, err)
+		}
+		started = append(started, t)
+	}
+
+	ru.announce(started, cycle)
+
+	return nil
+}
+
+// announce waits in the background for the started processes to pass their
+// ready checks; the run loop then moves to runStateRunning, tells the
+// auto-reloader and finishes cycle (if not nil).  An earlier announcement
+// still waiting is replaced, with its processes which are still running
+// carried over into this one; its cycle is finished as superseded, unless
+// it's cycle too.
+func (ru *runner) announce(started []*target, cycle *cycleTimings) {
+
+	if ru.readyCancel != nil {
+		if cycle != ru.announceCyc {
+			ru.finishCycle(ru.announceCyc, "superseded")
+		}
+		ru.readyCancel()
+		for _, t := range ru.announcing {
+			if t.cmd != nil && !containsTarget(started, t) {
+				started = append([]*target{t}, started...)
+			}
+		}
+	}
+	ru.announcing = started
+	if cycle != nil && cycle != ru.announceCyc { // a continued one is still timed from when it started waiting
+		cycle.readyStart = time.Now()
+	}
+	ru.announceCyc = cycle
+	ctx, cancel := context.WithCancel(context.Background())
+	ru.readyCancel = cancel
+	ru.readySeq++
+
+	rr := readyResult{seq: ru.readySeq, targets: started}
+	var rs []*readiness
+	for _, t := range started {
+		rr.pid = t.cmd.Process.Pid
+		rs = append(rs, t.readiness)
+	}
+
+	go func() {
+		var wg sync.WaitGroup
+		errs := make([]error, len(rs))
+		for i, r := range rs {
+			wg.Add(1)
+			go func(i int, r *readiness) {
+				defer wg.Done()
+				errs[i] = r.wait(ctx)
+			}(i, r)
+		}
+		wg.Wait()
+		for i, err := range errs {
 			if err != nil {
-				return fmt.Errorf("Unexpected process exit: %w", err)
+				if rr.err == nil {
+					rr.err = fmt.Errorf("%s: %w", started[i].name, err)
+				}
+				rr.failed = append(rr.failed, started[i])
 			}
+		}
+		ru.readyCh <- rr
+	}()
+}
+
+// readyResult is sent on readyCh once announce is done waiting
+type readyResult struct {
+	seq     int
+	pid     int // last pid started, 0 if only wasm targets were rebuilt
+	targets []*target
+	failed  []*target // those which didn't become ready
+	err     error     // the first of their errors
+}
+
+// start runs the built binary for t.
+func (ru *runner) start(t *target) error {
+
+	// new command, new channel
+	cmdErrCh := make(chan error, 1)
+
+	// attempt to run process
+	// if ru.isGoRunTarget() {
+	// 	args := []string{"run", ru.buildTarget}
+	// 	args = append(args, ru.args...)
+	// 	cmd = exec.Command("go", args...)
+	// } else {
+	cmd := exec.Command(t.outPath(ru.binDir), t.args...)
+	// }
+	env, err := loadEnvFiles(t.envFiles)
+	if err != nil {
+		return fmt.Errorf("unable to load env files: %w", err)
+	}
+	env = append(env, t.env...)
+	if t.listen != "" {
+		cmd, err = t.listenCmd(cmd.Path, t.args)
+		if err != nil {
 			return err
 		}
+		env = append(env, "LISTEN_FDS=1", "LISTEN_FDNAMES="+t.name)
+	}
 
+	rl := ru.logs.start(t, t.builds)
+	// Stdin stays nil (the null device): in a process group other than the
+	// terminal's foreground one, reading the terminal would get the process
+	// stopped by SIGTTIN
+	cmd.Stdout = rl.stdout
+	cmd.Stderr = rl.stderr
+	// its own process group, so it can be stopped along with anything it starts
+	setProcessGroup(cmd)
+
+	r := newReadiness(t.ready)
+	if t.ready != nil && t.ready.Stdout != "" {
+		cmd.Stdout = &markerWriter{w: cmd.Stdout, marker: []byte(t.ready.Stdout), found: r.markReady}
+	}
+	if t.ready != nil && t.ready.Notify {
+		p, err := listenNotify(r)
+		if err != nil {
+			rl.close()
+			return fmt.Errorf("unable to create notify socket: %w", err)
+		}
+		env = append(env, "NOTIFY_SOCKET="+p)
+	}
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
 	}
 
-	// unreachable
+	err = cmd.Start()
+	if err != nil {
+		r.close()
+		rl.close()
+		return err
+	}
+	t.readiness = r
+
+	t.cmd = cmd
+	t.cmdErrCh = cmdErrCh
+	t.startedAt = time.Now()
+
+	ru.procsMu.Lock()
+	ru.procs[cmd] = true
+	ru.procsMu.Unlock()
+
+	// wait in goroutine (convert blocking call to channel so we can `select` in run)
+	go func() {
+		err := cmd.Wait()
+		ru.procsMu.Lock()
+		delete(ru.procs, cmd)
+		ru.procsMu.Unlock()
+		r.close()
+		rl.close()
+		cmdErrCh <- err
+		select { // non-blocking send
+		case ru.exitCh <- targetExit{t: t, cmd: cmd}:
+		default:
+		}
+	}()
 
+	return nil
 }
 
-func (ru *runner) generateAndBuild() (reterr error) {
+// stop gracefully stops the running process for t, if any.
+func (ru *runner) stop(t *target) {
+	if t.cmd == nil {
+		return
+	}
+	if *flagV {
+		log.Printf("about to perform gracefulStop on %s pid=%v", t.name, t.cmd.Process.Pid)
+	}
+	gracefulStop(t.cmd, t.cmdErrCh, t.stop)
+	t.cmd = nil
+}
 
+// stopHandoff stops the previous process for t, if one was kept running for a listener handoff.
+func (ru *runner) stopHandoff(t *target) {
+	h := t.handoff
+	if h == nil {
+		return
+	}
+	t.handoff = nil
+	select {
+	case <-h.cmdErrCh: // already exited by itself
+		return
+	default:
+	}
 	if *flagV {
-		log.Printf("Running generateAndBuild")
-		defer func() {
-			log.Printf("Exiting generateAndBuild (err=%v)", reterr)
-		}()
+		log.Printf("about to perform gracefulStop on previous %s pid=%v", t.name, h.cmd.Process.Pid)
+	}
+	gracefulStop(h.cmd, h.cmdErrCh, t.stop)
+}
+
+// rollbackHandoff stops the process for t, which failed its ready check, and
+// puts back the previous one kept running for a listener handoff, so that it
+// carries on serving.  Without one (or if it has exited too) the new process
+// is left as it is.
+func (ru *runner) rollbackHandoff(t *target) {
+	h := t.handoff
+	if h == nil {
+		return
 	}
+	t.handoff = nil
+	select {
+	case <-h.cmdErrCh:
+		return
+	default:
+	}
+	ru.stop(t)
+	t.cmd, t.cmdErrCh = h.cmd, h.cmdErrCh
+	t.binID = "" // what's running isn't the latest build, the next one restarts it
+	log.Printf("Process %s failed its ready check, keeping the previous one (pid %d)", t.name, t.cmd.Process.Pid)
+}
 
-	if ru.generateDir != "" {
-		cmd := exec.Command("go", "generate")
-		cmd.Dir = ru.generateDir
-		if *flagV {
-			log.Printf("About to execute go: %v", cmd.Args)
+// killAll kills every process still running, including previous ones kept
+// for a listener handoff, along with their process groups.  Unlike stopAll it
+// is safe to call from any goroutine, it's for when we can't wait for the run
+// loop to stop them.
+func (ru *runner) killAll() {
+	ru.procsMu.Lock()
+	defer ru.procsMu.Unlock()
+	for cmd := range ru.procs {
+		err := killProcessGroup(cmd)
+		if err != nil && *flagV {
+			log.Printf("Unable to kill pid=%d: %v", cmd.Process.Pid, err)
 		}
-		b, err := cmd.CombinedOutput()
+	}
+}
+
+// stopAll stops every running target.
+func (ru *runner) stopAll() {
+	for _, t := range ru.targets {
+		ru.stopHandoff(t)
+		ru.stop(t)
+	}
+}
+
+// buildTargets builds each of targets.  It returns the targets which built
+// successfully, with the identity of each binary; the error is non-nil if any
+// of the builds failed.  It runs on the build goroutine, so it must not touch
+// what the run loop owns, changedTargets does that part once the build is done.
+func (ru *runner) buildTargets(ctx context.Context, targets []*target) (built []builtTarget, reterr error) {
+
+	var errs buildErrors
+	for _, t := range targets {
+		if ctx.Err() != nil {
+			return built, ctx.Err()
+		}
+		err := ru.build(ctx, t)
 		if err != nil {
-			if *flagV {
-				log.Printf("generateAndBuild error: %v", err)
+			be, ok := err.(*buildError)
+			if !ok {
+				be = newBuildError("build", t.name, "", err, nil)
 			}
-			return fmt.Errorf("generate error: %w; full output:\n%s", err, b)
+			errs = append(errs, be)
+			continue
 		}
+		if len(ru.targets) > 1 { // only needed to tell targets apart
+			t.updateDeps()
+		}
+		built = append(built, builtTarget{t: t, binID: t.binaryID(ru.binDir)})
+	}
+
+	if len(errs) > 0 {
+		return built, errs
 	}
+	return built, nil
+}
 
-	if ru.buildTarget == "" {
+// changedTargets returns the targets of built which need restarting, counting
+// a new build for each whose binary changed.  A target whose binary came out
+// the same as before isn't restarted, unless it has no running process.
+func (ru *runner) changedTargets(built []builtTarget) []*target {
+	var ret []*target
+	for _, b := range built {
+		t := b.t
+		if b.binID == "" || b.binID != t.binID {
+			t.binID = b.binID
+			t.builds++
+		} else if t.kind == targetKindWasm || t.cmd != nil {
+			log.Printf("Rebuild of %s was a no-op (binary unchanged), not restarting", t.name)
+			continue
+		}
+		ret = append(ret, t)
+	}
+	return ret
+}
+
+// build runs go build for t, writing the output to binDir (or the out dir for wasm targets).
+func (ru *runner) build(ctx context.Context, t *target) error {
+
+	if t.buildTarget == "" {
 		return fmt.Errorf("empty buildTarget")
 	}
 
@@ -244,82 +1013,128 @@ func (ru *runner) generateAndBuild() (reterr error) {
 	// 	return nil
 	// }
 
-	absBinDir, err := filepath.Abs(ru.binDir)
+	outPath, err := filepath.Abs(t.outPath(ru.binDir))
 	if err != nil {
 		if *flagV {
-			log.Printf("generateAndBuild filepath.Abs(ru.binDir) error: %v", err)
+			log.Printf("generateAndBuild filepath.Abs(outPath) error: %v", err)
 		}
 		return err
 	}
 
-	// create bin dir if it doesn't exist, but do not try to create parent dirs
-	os.Mkdir(absBinDir, 0755)
+	// create output dir if it doesn't exist, but do not try to create parent dirs
+	os.Mkdir(filepath.Dir(outPath), 0755)
 
-	outBase := strings.TrimSuffix(filepath.Base(ru.buildTarget), ".go")
+	args := append([]string{"build"}, t.buildFlags...)
+	args = append(args, "-o", outPath)
 	var cmd *exec.Cmd
-	if filepath.Ext(ru.buildTarget) == ".go" {
-		cmd = exec.Command("go", "build", "-o", filepath.Join(absBinDir, outBase)+exeSuffix(), ru.buildTarget) // .go file
+	if filepath.Ext(t.buildTarget) == ".go" {
+		cmd = exec.Command("go", append(args, t.buildTarget)...) // .go file
 	} else {
-		cmd = exec.Command("go", "build", "-o", filepath.Join(absBinDir, outBase)+exeSuffix()) // package
-		cmd.Dir, err = filepath.Abs(ru.buildTarget)
+		cmd = exec.Command("go", args...) // package
+		cmd.Dir, err = filepath.Abs(t.buildTarget)
 		if err != nil {
-			return fmt.Errorf("Unable to translate %q to an absolute path: %w", ru.buildTarget, err)
+			return fmt.Errorf("Unable to translate %q to an absolute path: %w", t.buildTarget, err)
 		}
 	}
+	if env := t.goEnv(); len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 	if *flagV {
-		log.Printf("About to execute go: %v (dir=%v)", cmd.Args, cmd.Dir)
+		log.Printf("About to execute go: %v (dir=%v, env=%v)", cmd.Args, cmd.Dir, t.goEnv())
 	}
-	b, err := cmd.CombinedOutput()
+	b, err := combinedOutputContext(ctx, cmd)
 	if err != nil {
 		if *flagV {
 			log.Printf("generateAndBuild go build error: %v", err)
 		}
-		return fmt.Errorf("build error: %w; full output:\n%s", err, b)
+		dir := cmd.Dir
+		if dir == "" {
+			dir = "."
+		}
+		return newBuildError("build", t.name, dir, err, b)
+	}
+
+	if t.kind == targetKindWasm {
+		err := copyWasmExecJS(filepath.Dir(outPath))
+		if err != nil {
+			return fmt.Errorf("error copying wasm_exec.js: %w", err)
+		}
 	}
 
 	return nil
 }
 
-// gracefulStop tries to stop a process using SIGINT and if that fails
-// SIGKILL, blocks until ch returns something (process dead)
-func gracefulStop(proc *os.Process, ch chan error, timeout time.Duration) {
+// gracefulStop stops the process started by cmd along with the rest of its
+// process group, as described by sc (nil for the defaults): the shutdown URL,
+// then each stop signal, then a kill.  ch receives the result of cmd.Wait(),
+// it blocks until that arrives (process dead).  A process which has already
+// exited is fine.
+func gracefulStop(cmd *exec.Cmd, ch chan error, sc *stopConfig) {
 
-	if *flagV {
-		log.Printf("gracefulStop running on pid=%v", proc.Pid)
-	}
+	pid := cmd.Process.Pid
+	timeout := sc.timeout()
+	var err error
 
-	err := proc.Signal(os.Interrupt)
-	if err != nil {
-		log.Printf("Signal error: %v", err)
-		goto kill
+	if *flagV {
+		log.Printf("gracefulStop running on pid=%v", pid)
 	}
 
-	if *flagV {
-		log.Printf("gracefulStop Signal(os.Interrupt) ok, waiting for error from channel")
+	if u := sc.url(); u != "" {
+		herr := callShutdownURL(u)
+		if herr != nil {
+			log.Printf("gracefulStop shutdown URL error: %v", herr)
+		} else {
+			if *flagV {
+				log.Printf("gracefulStop called %s, waiting for error from channel", u)
+			}
+			select {
+			case err = <-ch:
+				goto reportErr
+			case <-time.After(timeout):
+				log.Printf("gracefulStop hit timeout after calling %s", u)
+			}
+		}
 	}
 
-	select {
-	case err = <-ch:
-		goto reportErr
-	case <-time.After(timeout):
-		log.Printf("gracefulStop hit timeout")
-		goto kill
+	for _, sig := range sc.signals() {
+		// an error here most likely means it already exited, which we'll hear about on ch
+		serr := signalProcessGroup(cmd, sig)
+		if serr != nil && *flagV {
+			log.Printf("gracefulStop signal %v error: %v", sig, serr)
+		}
+		if *flagV {
+			log.Printf("gracefulStop sent %v, waiting for error from channel", sig)
+		}
+		select {
+		case err = <-ch:
+			goto reportErr
+		case <-time.After(timeout):
+			log.Printf("gracefulStop hit timeout after %v", sig)
+		}
 	}
 
-kill:
 	log.Printf("gracefulStop doing kill")
-	err = proc.Signal(os.Kill)
-	if err != nil {
-		// FIXME: ideally we would make sure this is not an error saying the process already exited
-		panic(err)
+	if kerr := killProcessGroup(cmd); kerr != nil {
+		log.Printf("gracefulStop kill error: %v", kerr)
 	}
 
 	if *flagV {
 		log.Printf("gracefulStop waiting for error from channel")
 	}
 
-	err = <-ch
+	select {
+	case err = <-ch:
+	case <-time.After(timeout):
+		log.Printf("gracefulStop giving up on pid=%v, it did not exit after being killed", pid)
+		return
+	}
+
 reportErr:
+	// anything it started and left behind in its process group goes too
+	if kerr := killProcessGroup(cmd); kerr != nil && *flagV {
+		log.Printf("gracefulStop cleaning up process group of pid=%v: %v", pid, kerr)
+	}
+
 	if *flagV {
 		if err != nil {
 			log.Printf("Process exited with error: %v", err)
@@ -48,13 +48,17 @@ func NewRWatcher() (*RWatcher, error) {
 	}
 
 	go func() {
+		defer close(events) // however we stop, so readers do too
 		for {
 			select {
 
 			case <-stop:
-				break
+				return
 
-			case event := <-w.Events:
+			case event, ok := <-w.Events:
+				if !ok { // closed
+					return
+				}
 
 				// log.Printf("RWatcher got event: %s", event)
 
@@ -125,7 +129,11 @@ func NewRWatcher() (*RWatcher, error) {
 				}
 
 			fwd: // forward to our separate event channel
-				events <- event
+				select {
+				case events <- event:
+				case <-stop:
+					return
+				}
 
 			}
 		}
@@ -165,7 +173,7 @@ func (rw *RWatcher) AddRecursive(name string) error {
 			return err
 		}
 		// bail on anything that matches the exclude patterns
-		for _, re := range defaultExcludePatterns {
+		for _, re := range rw.excludePatterns {
 			if re.MatchString(fpath) {
 				return nil
 			}
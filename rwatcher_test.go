@@ -35,7 +35,10 @@ func TestRWatcher(t *testing.T) {
 			case <-cancel:
 				break
 
-			case event := <-rw.Events:
+			case event, ok := <-rw.Events:
+				if !ok {
+					return
+				}
 
 				fmt.Printf("EVENT! %#v\n", event)
 
@@ -63,4 +66,19 @@ func TestRWatcher(t *testing.T) {
 	time.Sleep(time.Second * 5)
 	cancel <- struct{}{}
 
+	// Events is closed once watching stops, for consumers like the coalescer
+	rw2, err := NewRWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw2.Close()
+	select {
+	case _, ok := <-rw2.Events:
+		if ok {
+			t.Errorf("unexpected event after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Events not closed after Close")
+	}
+
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// stopConfig is how a target's process is stopped.  The shutdown URL is
+// called first if set, then each signal is sent to the process group in turn,
+// waiting up to timeout after each for it to exit, before it is killed.
+type stopConfig struct {
+	URL     string   `json:"url,omitempty"`     // POSTed to before any signals
+	Signals []string `json:"signals,omitempty"` // e.g. ["SIGTERM", "SIGINT"], default SIGINT
+	Timeout duration `json:"timeout,omitempty"` // wait after the URL and each signal, default 10s
+}
+
+func (sc *stopConfig) check() error {
+	for _, name := range sc.Signals {
+		if _, err := parseSignal(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sc *stopConfig) timeout() time.Duration {
+	if sc != nil && sc.Timeout > 0 {
+		return time.Duration(sc.Timeout)
+	}
+	return 10 * time.Second
+}
+
+func (sc *stopConfig) signals() []os.Signal {
+	if sc == nil || len(sc.Signals) == 0 {
+		return []os.Signal{os.Interrupt}
+	}
+	ret := make([]os.Signal, 0, len(sc.Signals))
+	for _, name := range sc.Signals {
+		sig, _ := parseSignal(name) // already checked
+		ret = append(ret, sig)
+	}
+	return ret
+}
+
+func (sc *stopConfig) url() string {
+	if sc == nil {
+		return ""
+	}
+	return sc.URL
+}
+
+// parseSignal returns the signal for a name such as "SIGTERM" or "TERM".
+func parseSignal(name string) (os.Signal, error) {
+	n := strings.ToUpper(name)
+	if !strings.HasPrefix(n, "SIG") {
+		n = "SIG" + n
+	}
+	sig, ok := stopSignals[n]
+	if !ok {
+		return nil, fmt.Errorf("unknown or unsupported stop signal %q", name)
+	}
+	return sig, nil
+}
+
+// callShutdownURL POSTs to u, asking the process to shut itself down.
+func callShutdownURL(u string) error {
+	client := &http.Client{Timeout: 2 * time.Second}
+	res, err := client.Post(u, "text/plain", nil)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("POST %s: %s", u, res.Status)
+	}
+	return nil
+}
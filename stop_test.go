@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestStopConfig(t *testing.T) {
+
+	sc := &stopConfig{Signals: []string{"term", "SIGKILL"}}
+	must(t, sc.check())
+	if sigs := sc.signals(); len(sigs) != 2 || sigs[1] != stopSignals["SIGKILL"] {
+		t.Errorf("unexpected signals %v", sigs)
+	}
+	if (*stopConfig)(nil).signals()[0] != os.Interrupt {
+		t.Errorf("default signal should be os.Interrupt")
+	}
+	if err := (&stopConfig{Signals: []string{"SIGNOPE"}}).check(); err == nil {
+		t.Errorf("expected error for unknown signal")
+	}
+
+	// stopping a process which already exited must not panic or hang
+	cmd := exec.Command("go", "version")
+	setProcessGroup(cmd)
+	must(t, cmd.Start())
+	ch := make(chan error, 1)
+	go func() { ch <- cmd.Wait() }()
+	for len(ch) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	done := make(chan struct{})
+	go func() {
+		gracefulStop(cmd, ch, &stopConfig{Timeout: duration(time.Second)})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("gracefulStop did not return")
+	}
+
+}
+
+func TestRollbackHandoff(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sleep")
+	}
+
+	start := func() (*exec.Cmd, chan error) {
+		cmd := exec.Command("sleep", "30")
+		setProcessGroup(cmd)
+		must(t, cmd.Start())
+		ch := make(chan error, 1)
+		go func() { ch <- cmd.Wait() }()
+		return cmd, ch
+	}
+	oldCmd, oldCh := start()
+	defer killProcessGroup(oldCmd)
+	newCmd, newCh := start()
+	defer killProcessGroup(newCmd)
+
+	// the new process failed its ready check, the old one carries on
+	tg := &target{name: "server", cmd: newCmd, cmdErrCh: newCh, binID: "x", stop: &stopConfig{Timeout: duration(time.Second)}}
+	tg.handoff = &handoff{cmd: oldCmd, cmdErrCh: oldCh}
+	(&runner{}).rollbackHandoff(tg)
+	if tg.cmd != oldCmd || tg.handoff != nil || tg.binID != "" {
+		t.Errorf("unexpected target after rollback: cmd=%v handoff=%v binID=%q", tg.cmd, tg.handoff, tg.binID)
+	}
+	if newCmd.ProcessState == nil { // set once gracefulStop saw it exit
+		t.Errorf("new process still running")
+	}
+	select {
+	case <-oldCh:
+		t.Errorf("old process stopped")
+	default:
+	}
+}
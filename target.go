@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// target is one program which the runner builds and keeps running.
+type target struct {
+	name        string     // used to prefix output and in log messages
+	kind        targetKind // what is built and whether it is run
+	buildTarget string     // either "filename.go" or e.g. "server" which is dir name of main pkg
+	args        []string   // cmdline args to be passed when running
+	binName     string     // name of the output file in binDir, without exe suffix
+	outDir      string     // where wasm targets write their output, empty means binDir
+
+	restartPolicy restartPolicy // what to do when the process exits by itself
+	ready         *readyConfig  // how to tell the process is ready, nil for the default delay
+	listen        string        // address vgrun listens on and hands to the process, empty for none
+	stop          *stopConfig   // how to stop the process, nil for the defaults
+
+	buildFlags []string // extra flags for go build
+	tags       []string // build tags, also needed by go list
+	buildEnv   []string // extra environment for go commands, as KEY=value
+	env        []string // extra environment for the process, as KEY=value
+	envFiles   []string // dotenv files read into the environment of the process each time it starts
+
+	cmd          *exec.Cmd  // actively running command, nil if not running
+	cmdErrCh     chan error // receives the result of cmd.Wait()
+	startedAt    time.Time  // when cmd was started
+	readiness    *readiness // ready check state for cmd
+	restartState restartState
+
+	listenFile *os.File // socket for listen, opened on first start and kept for the life of vgrun
+	handoff    *handoff // previous process, kept running until cmd is ready
+
+	deps   map[string]bool // absolute dirs of the non-std packages this target is built from, nil if unknown
+	binID  string          // identifies the content of the last binary built, empty if unknown
+	builds int             // how many different binaries have been built, numbers the output of each
+}
+
+type targetKind string
+
+const (
+	targetKindProcess = targetKind("")     // native binary which is run
+	targetKindWasm    = targetKind("wasm") // GOOS=js GOARCH=wasm client, built but not run
+)
+
+// targetConfig is how a target is described in the config file.
+type targetConfig struct {
+	Name   string     `json:"name"`
+	Kind   targetKind `json:"kind"`
+	Build  string     `json:"build"`
+	Args   []string   `json:"args"`
+	Bin    string     `json:"bin"`
+	OutDir string     `json:"out-dir"`
+
+	Restart restartPolicy `json:"restart"` // empty means the restart setting from the config
+	Ready   *readyConfig  `json:"ready"`
+	Listen  string        `json:"listen"` // address for vgrun to listen on and pass to the process
+
+	Stop     *stopConfig `json:"stop"`
+	EnvFiles []string    `json:"env-files"` // dotenv files for the process, in addition to the ones from the config
+
+	buildConfig
+}
+
+// buildConfig is how go build is run for a target and the environment its
+// process runs with.  ${VAR} in values is expanded from vgrun's environment.
+type buildConfig struct {
+	Tags       []string          `json:"tags"`
+	LDFlags    string            `json:"ldflags"`
+	GCFlags    string            `json:"gcflags"`
+	Race       bool              `json:"race"`
+	TrimPath   bool              `json:"trimpath"`
+	BuildFlags []string          `json:"build-flags"` // anything else to pass to go build
+	GoFlags    string            `json:"goflags"`     // GOFLAGS for go commands
+	BuildEnv   map[string]string `json:"build-env"`   // environment for go commands only
+	Env        map[string]string `json:"env"`         // environment for the process only
+}
+
+// flags returns the go build flags for bc.
+func (bc *buildConfig) flags() []string {
+	var ret []string
+	if len(bc.Tags) > 0 {
+		ret = append(ret, "-tags="+strings.Join(bc.Tags, ","))
+	}
+	if bc.LDFlags != "" {
+		ret = append(ret, "-ldflags="+os.ExpandEnv(bc.LDFlags))
+	}
+	if bc.GCFlags != "" {
+		ret = append(ret, "-gcflags="+os.ExpandEnv(bc.GCFlags))
+	}
+	if bc.Race {
+		ret = append(ret, "-race")
+	}
+	if bc.TrimPath {
+		ret = append(ret, "-trimpath")
+	}
+	for _, f := range bc.BuildFlags {
+		ret = append(ret, os.ExpandEnv(f))
+	}
+	return ret
+}
+
+// envList returns m as KEY=value pairs sorted by key, with values expanded.
+func envList(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ret := make([]string, 0, len(m))
+	for _, k := range keys {
+		ret = append(ret, k+"="+os.ExpandEnv(m[k]))
+	}
+	return ret
+}
+
+type targetConfigs []targetConfig
+
+func (tcs targetConfigs) resolvePaths(dir string) {
+	for i := range tcs {
+		tcs[i].Build = resolvePath(dir, tcs[i].Build)
+		tcs[i].OutDir = resolvePath(dir, tcs[i].OutDir)
+		for j := range tcs[i].EnvFiles {
+			tcs[i].EnvFiles[j] = resolvePath(dir, tcs[i].EnvFiles[j])
+		}
+	}
+}
+
+// newTarget returns a target for tc, filling in defaults for name and bin.
+func newTarget(tc targetConfig) *target {
+	t := &target{
+		name:        tc.Name,
+		kind:        tc.Kind,
+		buildTarget: tc.Build,
+		args:        tc.Args,
+		binName:     tc.Bin,
+		outDir:      tc.OutDir,
+
+		restartPolicy: tc.Restart,
+		ready:         tc.Ready,
+		listen:        tc.Listen,
+		stop:          tc.Stop,
+
+		buildFlags: tc.flags(),
+		tags:       tc.Tags,
+		buildEnv:   envList(tc.BuildEnv),
+		env:        envList(tc.Env),
+		envFiles:   tc.EnvFiles,
+	}
+	if tc.GoFlags != "" {
+		t.buildEnv = append(t.buildEnv, "GOFLAGS="+os.ExpandEnv(tc.GoFlags))
+	}
+	if t.binName == "" {
+		t.binName = strings.TrimSuffix(filepath.Base(t.buildTarget), ".go")
+		if t.kind == targetKindWasm {
+			t.binName = "main" // main.wasm by convention
+		}
+	}
+	if t.name == "" {
+		t.name = t.binName
+	}
+	return t
+}
+
+// outPath returns the file go build writes for this target.
+func (t *target) outPath(binDir string) string {
+	if t.kind == targetKindWasm {
+		dir := t.outDir
+		if dir == "" {
+			dir = binDir
+		}
+		return filepath.Join(dir, t.binName+".wasm")
+	}
+	return filepath.Join(binDir, t.binName+exeSuffix())
+}
+
+// binaryID identifies the content of the binary just built for this target,
+// so a rebuild producing the same one can be told apart; it's empty if that
+// isn't possible.  The content part of the Go build ID is used: unlike the
+// file itself, it stays the same when a change (e.g. to a comment) doesn't
+// affect the code.  A plain hash of the file is the fallback if the build ID
+// can't be read.
+func (t *target) binaryID(binDir string) string {
+	p := t.outPath(binDir)
+	b, err := exec.Command("go", "tool", "buildid", p).Output()
+	if id := strings.TrimSpace(string(b)); err == nil && id != "" {
+		return id[strings.LastIndex(id, "/")+1:]
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		if *flagV {
+			log.Printf("Unable to identify binary for %s: %v", t.name, err)
+		}
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil))
+}
+
+// goEnv returns the extra environment for go commands run on this target.
+func (t *target) goEnv() []string {
+	var ret []string
+	if t.kind == targetKindWasm {
+		ret = append(ret, "GOOS=js", "GOARCH=wasm")
+	}
+	return append(ret, t.buildEnv...)
+}
+
+// updateDeps refreshes the set of package dirs this target depends on, using `go list`.
+// On failure deps is set to nil, which means every change affects this target.
+func (t *target) updateDeps() {
+
+	cmd := exec.Command("go", "list", "-deps", "-f", "{{if not .Standard}}{{.Dir}}{{end}}")
+	if len(t.tags) > 0 {
+		cmd.Args = append(cmd.Args, "-tags="+strings.Join(t.tags, ","))
+	}
+	if filepath.Ext(t.buildTarget) == ".go" {
+		cmd.Args = append(cmd.Args, t.buildTarget)
+	} else {
+		cmd.Dir = t.buildTarget
+	}
+	if env := t.goEnv(); len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	b, err := cmd.Output()
+	if err != nil {
+		if *flagV {
+			log.Printf("Unable to list dependencies of %q: %v", t.name, err)
+		}
+		t.deps = nil
+		return
+	}
+
+	deps := make(map[string]bool)
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			deps[line] = true
+		}
+	}
+	t.deps = deps
+}
+
+// affectedBy returns true if a change to any of paths may change the output of this target.
+func (t *target) affectedBy(paths []string) bool {
+	if t.deps == nil || len(paths) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		switch filepath.Base(p) {
+		case "go.mod", "go.sum":
+			return true
+		}
+		absp, err := filepath.Abs(p)
+		if err != nil {
+			return true
+		}
+		if t.deps[filepath.Dir(absp)] {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *target) String() string {
+	return t.name
+}
+
+// usesEnvFile returns true if p is one of the env files of t.
+func (t *target) usesEnvFile(p string) bool {
+	absp, err := filepath.Abs(p)
+	if err != nil {
+		return false
+	}
+	for _, f := range t.envFiles {
+		if absf, err := filepath.Abs(f); err == nil && absf == absp {
+			return true
+		}
+	}
+	return false
+}
+
+// containsTarget returns true if t is one of targets.
+func containsTarget(targets []*target, t *target) bool {
+	for _, t2 := range targets {
+		if t2 == t {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTargets makes sure target names and output files are unique.
+func checkTargets(targets []*target) error {
+	names := make(map[string]bool, len(targets))
+	bins := make(map[string]bool, len(targets))
+	for _, t := range targets {
+		switch t.kind {
+		case targetKindProcess, targetKindWasm:
+		default:
+			return fmt.Errorf("target %q has unknown kind %q", t.name, t.kind)
+		}
+		if t.buildTarget == "" {
+			return fmt.Errorf("target %q has no build target", t.name)
+		}
+		if err := t.restartPolicy.check(); err != nil {
+			return fmt.Errorf("target %q: %w", t.name, err)
+		}
+		if t.ready != nil {
+			if err := t.ready.check(); err != nil {
+				return fmt.Errorf("target %q: %w", t.name, err)
+			}
+		}
+		if t.stop != nil {
+			if err := t.stop.check(); err != nil {
+				return fmt.Errorf("target %q: %w", t.name, err)
+			}
+		}
+		if t.listen != "" {
+			if t.kind == targetKindWasm {
+				return fmt.Errorf("target %q: listen is not possible for wasm targets", t.name)
+			}
+			if !listenSupported {
+				return fmt.Errorf("target %q: listen is not supported on this platform", t.name)
+			}
+		}
+		if names[t.name] {
+			return fmt.Errorf("duplicate target name %q", t.name)
+		}
+		names[t.name] = true
+		out := t.outPath("")
+		if bins[out] {
+			return fmt.Errorf("duplicate target output %q (set \"bin\" on one of them)", out)
+		}
+		bins[out] = true
+	}
+	return nil
+}
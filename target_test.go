@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestTargetBuildConfig(t *testing.T) {
+
+	os.Setenv("VGRUN_TEST_VERSION", "1.2.3")
+	defer os.Unsetenv("VGRUN_TEST_VERSION")
+
+	var tc targetConfig
+	must(t, json.Unmarshal([]byte(`{
+		"build": "server",
+		"tags": ["dev", "sqlite"],
+		"ldflags": "-X main.version=${VGRUN_TEST_VERSION}",
+		"race": true,
+		"build-flags": ["-mod=vendor"],
+		"goflags": "-count=1",
+		"build-env": {"CGO_ENABLED": "1"},
+		"env": {"PORT": "8844", "VERSION": "v${VGRUN_TEST_VERSION}"}
+	}`), &tc))
+
+	tg := newTarget(tc)
+
+	wantFlags := []string{"-tags=dev,sqlite", "-ldflags=-X main.version=1.2.3", "-race", "-mod=vendor"}
+	if !reflect.DeepEqual(tg.buildFlags, wantFlags) {
+		t.Errorf("unexpected build flags %q", tg.buildFlags)
+	}
+	wantBuildEnv := []string{"CGO_ENABLED=1", "GOFLAGS=-count=1"}
+	if !reflect.DeepEqual(tg.goEnv(), wantBuildEnv) {
+		t.Errorf("unexpected build env %q", tg.goEnv())
+	}
+	wantEnv := []string{"PORT=8844", "VERSION=v1.2.3"}
+	if !reflect.DeepEqual(tg.env, wantEnv) {
+		t.Errorf("unexpected env %q", tg.env)
+	}
+
+}
+
+func TestChangedTargets(t *testing.T) {
+
+	ru := &runner{}
+	a := &target{name: "a"}
+	b := &target{name: "b", binID: "x", builds: 1, cmd: &exec.Cmd{}}
+	c := &target{name: "c", binID: "y", builds: 1} // not running, started even though unchanged
+
+	got := ru.changedTargets([]builtTarget{{t: a, binID: "w"}, {t: b, binID: "x"}, {t: c, binID: "y"}})
+	if !reflect.DeepEqual(got, []*target{a, c}) {
+		t.Errorf("unexpected targets %v", got)
+	}
+	if a.builds != 1 || a.binID != "w" || b.builds != 1 || c.builds != 1 {
+		t.Errorf("unexpected builds a=%d b=%d c=%d", a.builds, b.builds, c.builds)
+	}
+
+	// an unknown binary always counts as changed
+	got = ru.changedTargets([]builtTarget{{t: b}})
+	if len(got) != 1 || b.builds != 2 {
+		t.Errorf("unexpected targets %v, builds %d", got, b.builds)
+	}
+}
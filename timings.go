@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cycleTimings is how long each part of one rebuild cycle took, from the
+// change which caused it until the new processes were ready.  Durations are
+// in seconds, parts which didn't happen (e.g. generate with -no-generate) are
+// zero.
+type cycleTimings struct {
+	Trigger  time.Time `json:"trigger"` // when the changes were seen, after debouncing
+	Targets  []string  `json:"targets"` // targets which were built
+	Outcome  string    `json:"outcome"` // "ok", "no-op", "build-failed", "ready-failed" or "superseded"
+	Wait     float64   `json:"wait"`    // waiting for a build already running to finish
+	Generate float64   `json:"generate"`
+	Build    float64   `json:"build"`
+	Stages   float64   `json:"stages"` // the other pipeline stages
+	Stop     float64   `json:"stop"`   // stopping the old processes
+	Start    float64   `json:"start"`  // starting the new ones
+	Ready    float64   `json:"ready"`  // the new ones passing their ready checks
+	Total    float64   `json:"total"`
+
+	readyStart time.Time
+}
+
+// newCycle returns the timings for a cycle triggered at trigger, with its build starting now.
+func newCycle(trigger time.Time) *cycleTimings {
+	now := time.Now()
+	if trigger.IsZero() || trigger.After(now) {
+		trigger = now
+	}
+	return &cycleTimings{Trigger: trigger, Wait: now.Sub(trigger).Seconds()}
+}
+
+// built records the pipeline's part of the cycle.
+func (c *cycleTimings) built(targets []*target, results []stageResult) {
+	for _, t := range targets {
+		c.Targets = append(c.Targets, t.name)
+	}
+	for _, r := range results {
+		switch r.Name {
+		case stageGenerate:
+			c.Generate += r.Duration
+		case stageBuild:
+			c.Build += r.Duration
+		default:
+			c.Stages += r.Duration
+		}
+	}
+}
+
+// String returns the compact form printed after each cycle, e.g.
+// `ok in 1.84s (generate 0.31s, build 1.12s, stop 0.05s, start 0.01s, ready 0.35s)`.
+func (c *cycleTimings) String() string {
+	var parts []string
+	for _, p := range []struct {
+		name string
+		d    float64
+	}{
+		{"wait", c.Wait}, {"generate", c.Generate}, {"build", c.Build}, {"stages", c.Stages},
+		{"stop", c.Stop}, {"start", c.Start}, {"ready", c.Ready},
+	} {
+		if p.d >= 0.005 {
+			parts = append(parts, fmt.Sprintf("%s %.2fs", p.name, p.d))
+		}
+	}
+	return fmt.Sprintf("%s in %.2fs (%s)", c.Outcome, c.Total, strings.Join(parts, ", "))
+}
+
+// finishCycle records the outcome of c, unless an earlier part of it already
+// failed, prints it and adds it to the history.  A nil c is ignored.
+func (ru *runner) finishCycle(c *cycleTimings, outcome string) {
+	if c == nil {
+		return
+	}
+	if c.Outcome == "" {
+		c.Outcome = outcome
+	}
+	c.Total = time.Since(c.Trigger).Seconds()
+	log.Printf("Timings: %v", c)
+	ru.timings.add(c)
+}
+
+// timingHistory keeps the timings of the most recent cycles.  It is safe for
+// concurrent use and serves them as JSON over HTTP.
+type timingHistory struct {
+	mu     sync.Mutex
+	size   int // how many cycles are kept, 0 means none
+	cycles []*cycleTimings
+}
+
+func (h *timingHistory) add(c *cycleTimings) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.size <= 0 {
+		return
+	}
+	h.cycles = append(h.cycles, c)
+	if len(h.cycles) > h.size {
+		h.cycles = append([]*cycleTimings(nil), h.cycles[len(h.cycles)-h.size:]...)
+	}
+}
+
+// list returns a copy of the history, oldest first.
+func (h *timingHistory) list() []cycleTimings {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ret := make([]cycleTimings, 0, len(h.cycles))
+	for _, c := range h.cycles {
+		ret = append(ret, *c)
+	}
+	return ret
+}
+
+// ServeHTTP responds with the history as JSON along with the mean of each
+// part, over the cycles which completed ("ok" or "no-op").
+func (h *timingHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	cycles := h.list()
+	var mean cycleTimings
+	n := 0
+	for _, c := range cycles {
+		if c.Outcome != "ok" && c.Outcome != "no-op" {
+			continue
+		}
+		n++
+		mean.Wait += c.Wait
+		mean.Generate += c.Generate
+		mean.Build += c.Build
+		mean.Stages += c.Stages
+		mean.Stop += c.Stop
+		mean.Start += c.Start
+		mean.Ready += c.Ready
+		mean.Total += c.Total
+	}
+	var meanm map[string]float64
+	if n > 0 {
+		f := float64(n)
+		meanm = map[string]float64{
+			"wait": mean.Wait / f, "generate": mean.Generate / f, "build": mean.Build / f, "stages": mean.Stages / f,
+			"stop": mean.Stop / f, "start": mean.Start / f, "ready": mean.Ready / f, "total": mean.Total / f,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Cycles []cycleTimings     `json:"cycles"`
+		Mean   map[string]float64 `json:"mean,omitempty"`
+	}{Cycles: cycles, Mean: meanm})
+}
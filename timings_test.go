@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestTimingHistory(t *testing.T) {
+
+	h := &timingHistory{size: 2}
+	for i, o := range []string{"ok", "build-failed", "ok"} {
+		h.add(&cycleTimings{Outcome: o, Build: float64(i + 1), Total: float64(i + 1)})
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/timings", nil))
+	var res struct {
+		Cycles []cycleTimings
+		Mean   map[string]float64
+	}
+	err := json.Unmarshal(rec.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Cycles) != 2 || res.Cycles[0].Outcome != "build-failed" {
+		t.Errorf("unexpected cycles %+v", res.Cycles)
+	}
+	if res.Mean["build"] != 3 { // failed cycles don't count
+		t.Errorf("unexpected mean %v", res.Mean)
+	}
+
+	// merged requests keep the earliest trigger
+	t1 := time.Now()
+	t2 := t1.Add(time.Second)
+	r := runStateChangeReq{changes: []string{"a"}, trigger: t2}.merge(runStateChangeReq{changes: []string{"b"}, trigger: t1})
+	if !r.trigger.Equal(t1) {
+		t.Errorf("unexpected trigger %v", r.trigger)
+	}
+
+}
+
+func TestAnnounceContinuesCycle(t *testing.T) {
+
+	ru := newRunner()
+	proc := func(name string) *target {
+		return &target{name: name, cmd: &exec.Cmd{Process: &os.Process{Pid: 1}}, readiness: newReadiness(&readyConfig{Stdout: "ready"})}
+	}
+	a, b := proc("a"), proc("b")
+
+	// a backoff restart of b while a rebuild of a is still waiting to be ready
+	cycle := newCycle(time.Now())
+	ru.announce([]*target{a}, cycle)
+	readyStart := cycle.readyStart
+	ru.announce([]*target{b}, ru.announceCyc)
+	defer ru.readyCancel()
+
+	if len(ru.timings.list()) != 0 {
+		t.Errorf("cycle should not be finished, got %+v", ru.timings.list())
+	}
+	if ru.announceCyc != cycle || !cycle.readyStart.Equal(readyStart) {
+		t.Errorf("cycle not carried on")
+	}
+	if !containsTarget(ru.announcing, a) || !containsTarget(ru.announcing, b) {
+		t.Errorf("unexpected targets %v", ru.announcing)
+	}
+}
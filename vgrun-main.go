@@ -1,33 +1,69 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"syscall"
 	"time"
-
-	"github.com/fsnotify/fsnotify"
 )
 
 var flagV = flag.Bool("v", false, "Verbose output")
 
 func main() {
 
+	// we are the shim between vgrun and a process which is passed a listener, see listen.go
+	if len(os.Args) > 1 && os.Args[1] == listenExecArg {
+		err := listenExec(os.Args[2:])
+		log.Fatal(err)
+	}
+
 	// TODO: set flag.Usage
+	// flags whose name matches a config key (see config.go) are read through
+	// loadConfig rather than directly, so the config file and env can set them
 	flagInstallTools := flag.Bool("install-tools", false, "Installs common Vugu tools using `go install`")
-	flagNoGenerate := flag.Bool("no-generate", false, "Disable `go generate`")
-	flagBinDir := flag.String("bin-dir", "bin", "Directory of where to place built binary")
+	flag.Bool("no-generate", false, "Disable `go generate`")
+	flag.String("generate-dirs", ".", "Comma separated directories to run `go generate` in, those with changed files are run in parallel")
+	flag.Bool("generate-auto", false, "Run `go generate` in each directory with a //go:generate directive, instead of generate-dirs")
+	flag.Int("generate-parallel", 0, "How many `go generate` commands to run at once, 0 means one per CPU")
+	flag.String("bin-dir", "bin", "Directory of where to place built binary")
 	flag1 := flag.Bool("1", false, "Run only once and exit after")
-	flagAutoReloadAt := flag.String("auto-reload-at", "localhost:8324", "Run auto-reload server using this listener.  An empty string will disable it.")
+	flag.String("auto-reload-at", "localhost:8324", "Run auto-reload server using this listener.  An empty string will disable it.")
 	flagNewFromExample := flag.String("new-from-example", "", "Initialize a new project from example.  Will git clone from github.com/vugu-examples/[value] or if value contains a slash it will be treated as a full URL sent to git clone.  Must be followed by empty or non existent target directory.")
 	flagKeepGit := flag.Bool("keep-git", false, "With new-from-example causes the .git folder to not be removed after cloning")
-	flagWatchPattern := flag.String("watch-pattern", "\\.vugu$", "Sets the regexp pattern of files to watch")
-	flagWatchDir := flag.String("watch-dir", ".", "Specifies which directory to watch from")
+	flag.String("watch-pattern", "\\.vugu$", "Sets the regexp pattern of files which regenerate and rebuild when changed, ahead of the defaults for .vugu, .go, .html, .js and .css files.  Ignored if the config file has rules.")
+	flag.String("watch-dir", ".", "Specifies which directory to watch from")
+	flag.Duration("debounce", 300*time.Millisecond, "Wait for file changes to stop for this long before acting on them")
+	flag.Duration("debounce-max-wait", 3*time.Second, "Act on file changes after at most this long, even if they haven't stopped")
+	flag.String("restart", string(restartExit), "What to do when a process exits by itself: exit (vgrun exits too), wait-for-change (start it again after the next rebuild) or always (start it again with backoff, until it crash loops)")
+	flag.String("listen", "", "Address for vgrun to listen on and pass to the process as an inherited socket (LISTEN_FDS), so the port stays up across restarts")
+	flag.String("env-files", "", "Comma separated dotenv files to load into the environment of each process; they are watched and processes restart when they change")
+	flag.String("tags", "", "Comma separated build tags, passed to go build as -tags")
+	flag.String("ldflags", "", "Passed to go build as -ldflags, ${VAR} is expanded from the environment")
+	flag.String("gcflags", "", "Passed to go build as -gcflags, ${VAR} is expanded from the environment")
+	flag.Bool("race", false, "Build with the race detector enabled")
+	flag.Bool("trimpath", false, "Passed to go build as -trimpath")
+	flag.Bool("cancel-builds", true, "Cancel an in-progress generate or build when newer changes arrive")
+	flag.Int("timing-history", 100, "How many rebuild cycles to keep the timings of, served as JSON at /timings on the auto-reload server")
+	flag.Int("log-buffer", 1000, "How many lines of output to keep in memory for each process, served as JSON at /logs on the auto-reload server")
+	flag.Bool("log-prefix", false, "Prefix process output with the target name, even with only one target")
+	flag.Bool("log-color", false, "Color the target name prefixes and highlight log-include matches")
+	flag.String("log-include", "", "Only print lines of process output matching this regexp")
+	flag.String("log-exclude", "", "Don't print lines of process output matching this regexp")
+	flag.String("log-dir", "", "Write the output of each run of a process to a file in this directory, e.g. .vgrun/logs")
+	flag.Int("log-keep", 10, "How many log files to keep for each target in log-dir, the oldest are removed")
+	flag.Int("log-browser-rate", 50, "Most lines of process output per second sent to each browser tab which turned it on with vgrunLogs() in the console, the rest are dropped")
+	flag.String("browser-console", "all", "Browser console output printed here: all, errors (console.error, uncaught errors and unhandled rejections) or off")
+	flag.String("json-file", "", "Write the result of each build, with parsed diagnostics, as lines of JSON to this file (\"-\" for stdout)")
+	flagConfig := flag.String("config", "", "Path to the config file; by default "+configFileName+" is looked for in the current directory and its parents up to the go.mod root")
+	flagPrintConfig := flag.Bool("print-config", false, "Print the effective config and where each value came from, then exit")
 	flag.Parse()
 
 	// build directory (and exe name) is first and only arg; or if it ends with .go then that file
@@ -147,117 +183,282 @@ func main() {
 		return
 	}
 
-	args := flag.Args()
-	if len(args) < 1 {
+	// settings from here on come from the config, which layers the file,
+	// environment and flags above on top of each other
+	configPath := *flagConfig
+	if configPath == "" {
+		configPath = os.Getenv("VGRUN_CONFIG")
+	}
+	cfg, err := loadConfig(flag.CommandLine, configPath)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	cfg.setArgs(flag.Args())
+	*flagV = cfg.Verbose
+
+	if *flagPrintConfig {
+		err := cfg.print(os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if cfg.path != "" && *flagV {
+		log.Printf("Using config file %q", cfg.path)
+	}
+
+	tcs := cfg.targetConfigs()
+	if len(tcs) == 0 {
 		log.Fatalf("You must provide something to run, either the path to the main package or a .go file.")
 	}
 
 	ru := newRunner()
-	ru.binDir = *flagBinDir
-	ru.generateDir = "."
-	if *flagNoGenerate {
-		ru.generateDir = ""
+	ru.binDir = cfg.BinDir
+	ru.cancelStaleBuilds = cfg.CancelBuilds
+	ru.timings.size = cfg.TimingHistory
+	if !cfg.NoGenerate {
+		ru.generateDirs = cfg.GenerateDirs
+		ru.generateAuto = cfg.GenerateAuto
+		ru.generateParallel = cfg.GenerateParallel
+	}
+	ru.pipeline, err = newPipeline(cfg.Stages)
+	if err != nil {
+		log.Fatalf("Invalid stages: %v", err)
+	}
+	for _, tc := range tcs {
+		if tc.Restart == "" {
+			tc.Restart = cfg.Restart
+		}
+		if tc.Kind != targetKindWasm {
+			tc.EnvFiles = append(cfg.EnvFiles[:len(cfg.EnvFiles):len(cfg.EnvFiles)], tc.EnvFiles...)
+		}
+		ru.targets = append(ru.targets, newTarget(tc))
+	}
+	err = checkTargets(ru.targets)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ru.logs.size = cfg.LogBuffer
+	ru.logs.prefix = cfg.LogPrefix || len(ru.targets) > 1 // tell the output apart when there's more than one
+	ru.logs.color = cfg.LogColor
+	if cfg.LogInclude != "" {
+		ru.logs.include, err = regexp.Compile(cfg.LogInclude)
+		if err != nil {
+			log.Fatalf("Invalid log-include: %v", err)
+		}
+	}
+	if cfg.LogExclude != "" {
+		ru.logs.exclude, err = regexp.Compile(cfg.LogExclude)
+		if err != nil {
+			log.Fatalf("Invalid log-exclude: %v", err)
+		}
 	}
-	ru.buildTarget = args[0]
-	ru.args = args[1:]
+	ru.logs.dir = cfg.LogDir
+	ru.logs.keep = cfg.LogKeep
 
 	ar := newAutoReloader()
 	ru.setPider = ar
+	ru.reloader = ar
+	ru.buildReporters = append(ru.buildReporters, ar)
+	ar.lastBuild = ru.lastBuildReport
+	ar.logRate = cfg.LogBrowserRate
+	switch cfg.BrowserConsole {
+	case "all", "errors", "off":
+		ar.browserConsole = cfg.BrowserConsole
+	default:
+		log.Fatalf("Invalid browser-console %q, must be all, errors or off", cfg.BrowserConsole)
+	}
+	ru.logs.subscribers = append(ru.logs.subscribers, ar)
+	for _, t := range ru.targets {
+		if t.kind == targetKindWasm { // only they send panics to symbolize
+			ar.sources.warm()
+			break
+		}
+	}
+
+	switch cfg.JSONFile {
+	case "":
+	case "-":
+		ru.buildReporters = append(ru.buildReporters, &jsonReporter{w: os.Stdout})
+	default:
+		f, err := os.OpenFile(cfg.JSONFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalf("Error opening JSON output file: %v", err)
+		}
+		defer f.Close()
+		ru.buildReporters = append(ru.buildReporters, &jsonReporter{w: f})
+	}
 
 	// only watch if not -1
+	var rwatcher *RWatcher
 	if !*flag1 {
-		watchPattern := regexp.MustCompile(*flagWatchPattern)
-
-		if *flagWatchDir == "" {
+		if cfg.WatchDir == "" {
 			log.Fatal("You must specify a watch dir in order to watch")
 		}
-		rwatcher, err := NewRWatcher()
+
+		// without rules in the config, anything matching the watch pattern regenerates;
+		// either way the defaults cover whatever they don't
+		rules := cfg.Rules
+		if len(rules) == 0 {
+			rules = changeRules{{Pattern: cfg.WatchPattern, Action: actionRegenerate}}
+		}
+		rules = append(append(changeRules(nil), rules...), defaultChangeRules...)
+		classifier, err := newChangeClassifier(cfg.WatchDir, rules)
+		if err != nil {
+			log.Fatalf("Invalid watch rules: %v", err)
+		}
+		rwatcher, err = NewRWatcher()
 		if err != nil {
 			log.Fatal(err)
 		}
-		rwatcher.AddRecursive(*flagWatchDir)
+		for _, p := range cfg.WatchExclude {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				log.Fatalf("Invalid watch exclude pattern %q: %v", p, err)
+			}
+			rwatcher.excludePatterns = append(rwatcher.excludePatterns, re)
+		}
+		rwatcher.AddRecursive(cfg.WatchDir)
+
+		// env files restart the processes using them, wherever they are
+		absWatchDir, err := filepath.Abs(cfg.WatchDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		envFiles := make(map[string]bool)
+		for _, t := range ru.targets {
+			for _, f := range t.envFiles {
+				absf, err := filepath.Abs(f)
+				if err != nil {
+					log.Fatal(err)
+				}
+				rel, err := filepath.Rel(absWatchDir, absf)
+				if !envFiles[absf] && (err != nil || strings.HasPrefix(rel, "..")) {
+					err := rwatcher.Add(filepath.Dir(absf))
+					if err != nil {
+						log.Printf("Unable to watch env file %q: %v", f, err)
+					}
+				}
+				envFiles[absf] = true
+			}
+		}
+
+		// events are batched into change sets, once things go quiet
+		co := newCoalescer(rwatcher.Events, time.Duration(cfg.Debounce), time.Duration(cfg.DebounceMaxWait))
+		go co.run(nil)
 
 		go func() {
-			lastChangeDetected := time.Now()
-		watchLoop:
 			for {
 				select {
 
-				case event := <-rwatcher.Events:
-
-					if *flagV {
-						log.Printf("DEBUG: watcher: %q %v", event.Name, event.Op)
-					}
-
-					switch event.Op {
-					case fsnotify.Create:
-					case fsnotify.Remove:
-					case fsnotify.Write:
-					default:
-						continue // ignore others
+				case cs := <-co.Out:
+					seen := time.Now()
+
+					// work out the most significant action, the runner only
+					// needs to hear about files which need a rebuild
+					action := actionIgnore
+					var cssPaths, restartPaths, buildPaths, inputPaths []string
+					generate := false
+					for _, p := range cs.paths() {
+						a := classifier.classify(p)
+						if absp, err := filepath.Abs(p); err == nil && envFiles[absp] {
+							a = actionRestart
+						}
+						if ru.isBuildOutput(p) {
+							// written by go build, the runner restarts and reloads as needed
+							a = actionIgnore
+						} else if ru.pipeline.isOutput(p) {
+							// a stage wrote it, the pipeline takes care of anything
+							// depending on it but browsers may still need to know
+							if a > actionReload {
+								a = actionIgnore
+							}
+						} else if ru.pipeline.isInput(p) {
+							inputPaths = append(inputPaths, p)
+						}
+						switch a {
+						case actionCSS:
+							cssPaths = append(cssPaths, p)
+						case actionRestart:
+							restartPaths = append(restartPaths, p)
+						case actionRegenerate:
+							generate = true
+							fallthrough
+						case actionRebuild:
+							buildPaths = append(buildPaths, p)
+						}
+						if a > action {
+							action = a
+						}
 					}
 
-					if watchPattern.MatchString(event.Name) {
+					switch action {
 
-						// HACK: we need to do some de-bouncing here.
-						// On Windows I'm getting a WRITE on startup for every file, plus
-						// file edits are resulting in two WRITE events per file.  Not
-						// sure what's causing it but we need it to chill out for this to
-						// be workable.
-						if time.Since(lastChangeDetected) < time.Second*4 {
-							if *flagV {
-								log.Printf("watcher: %q %v, change detected too quickly, debouncing", event.Name, event.Op)
-							}
-							continue watchLoop
+					case actionIgnore:
+						if *flagV {
+							log.Printf("watcher: ignoring %v", cs)
 						}
-						lastChangeDetected = time.Now()
 
+					// browser-only changes don't involve the runner
+					case actionCSS:
 						if *flagV {
-							log.Printf("watcher: %q %v, rebuilding and restarting...", event.Name, event.Op)
-						} else {
-							log.Printf("Generate and Rebuild: %s", event.Name)
+							log.Printf("watcher: %v, updating stylesheets", cs)
 						}
+						ar.reloadCSS(cssPaths)
 
-						// consume anything on the state change channel
-						for len(ru.runStateUpdateCh) > 0 {
-							rs := <-ru.runStateUpdateCh
-							_ = rs
-							// log.Printf("runState changed to: %v", rs)
+					case actionReload:
+						if *flagV {
+							log.Printf("watcher: %v, reloading browsers", cs)
+						}
+						ar.reload()
+
+					// same binaries, only a restart is needed
+					case actionRestart:
+						log.Printf("Restart: %v", cs)
+						ru.runStateChangeReqCh <- runStateChangeReq{
+							kind:    runStateChangeReqRestart,
+							changes: restartPaths,
+							trigger: seen,
 						}
 
-						// ask the runner to rebuild and restart
-						ru.runStateChangeReqCh <- runStateChangeReqRebuildAndRestart
-
-						// read its events until it tells us that it restarted
-					waitRunStateChanges:
-						for rs := range ru.runStateUpdateCh {
-							// log.Printf("runState changed to: %v", rs)
-							switch rs {
-
-							// if rebuild fail we just go back to waiting for events
-							case runStateRebuildFail:
-								continue watchLoop
-
-							case runStateNone, runStateRebuildSuccess:
-								// doesn't mean anything for us
-								continue
-
-							case runStateRunning:
-								// it's back up, drop through and send message to any browsers listening
-								break waitRunStateChanges
+					case actionRebuild, actionRegenerate:
 
-							}
+						if generate {
+							log.Printf("Generate and Rebuild: %v", cs)
+						} else {
+							log.Printf("Rebuild: %v", cs)
 						}
 
-						// drain the channel to len 0 before continuing - we don't want a bunch of
-						// file change events stacked up while we were waiting for the build
-						for len(rwatcher.Events) > 0 {
-							<-rwatcher.Events
-						}
+						// ask the runner to rebuild and restart (which reloads browsers);
+						// we don't wait for it, any changes while it's busy are merged
+						// and built once it's done
+						ru.addPending(runStateChangeReq{
+							kind:     runStateChangeReqRebuildAndRestart,
+							changes:  buildPaths,
+							inputs:   inputPaths,
+							restarts: restartPaths,
+							generate: generate,
+							trigger:  seen,
+						}, true)
+
+					}
 
+					// stage inputs which didn't cause a rebuild above still run their stages
+					if len(inputPaths) > 0 && action < actionRebuild {
+						log.Printf("Run stages: %v", cs)
+						ru.addPending(runStateChangeReq{
+							kind:    runStateChangeReqRebuildAndRestart,
+							inputs:  inputPaths,
+							trigger: seen,
+						}, true)
 					}
 
-				case err := <-rwatcher.Errors:
+				case err, ok := <-rwatcher.Errors:
+					if !ok { // closed, we're shutting down
+						return
+					}
 					log.Printf("watcher error: %v", err)
 
 				}
@@ -267,17 +468,66 @@ func main() {
 	}
 
 	if *flagV {
-		log.Printf("Starting auto-reload server at %q", *flagAutoReloadAt) // should be only in verbose mode
+		log.Printf("Starting auto-reload server at %q", cfg.AutoReloadAt) // should be only in verbose mode
 	}
+	mux := http.NewServeMux()
+	mux.Handle("/timings", ru.timings)
+	mux.Handle("/logs", ru.logs)
+	mux.Handle("/", ar)
 	go func() {
-		log.Fatal(http.ListenAndServe(*flagAutoReloadAt, ar))
+		log.Fatal(http.ListenAndServe(cfg.AutoReloadAt, mux))
 	}()
 
-	err := ru.run()
-	if err != nil {
+	// processes are in process groups of their own so a ^C meant for us
+	// doesn't reach them, we stop them through the runner and then exit;
+	// a second signal kills them and exits straight away
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	stoppedBy := make(chan os.Signal, 1)
+	go func() {
+		sig := <-sigCh
+		log.Printf("Received %v, shutting down", sig)
+		stoppedBy <- sig
+		if rwatcher != nil {
+			rwatcher.Close()
+		}
+		ru.runStateChangeReqCh <- runStateChangeReq{kind: runStateChangeReqStop}
+		sig = <-sigCh
+		log.Printf("Received %v again, exiting now", sig)
+		ru.killAll()
+		os.Exit(signalExitCode(sig))
+	}()
+
+	err = ru.run()
+	ar.shutdown(time.Second)
+
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr): // exit how the process did
+		log.Print(err)
+		code := exitErr.ExitCode()
+		if code <= 0 { // killed by a signal
+			code = 1
+		}
+		os.Exit(code)
+	case err != nil:
 		log.Fatal(err)
 	}
 
+	select {
+	case sig := <-stoppedBy:
+		os.Exit(signalExitCode(sig))
+	default:
+	}
+
+}
+
+// signalExitCode is the conventional exit status after being stopped by sig, 128 plus the signal number.
+func signalExitCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return 1
 }
 
 /*
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// goToolchainWasmExecJS returns the path to wasm_exec.js which ships with the
+// active Go toolchain, along with the toolchain version.
+func goToolchainWasmExecJS() (path, version string, err error) {
+
+	b, err := exec.Command("go", "env", "GOROOT", "GOVERSION").Output()
+	if err != nil {
+		return "", "", fmt.Errorf("unable to run `go env`: %w", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	goroot := strings.TrimSpace(lines[0])
+	version = "unknown version" // GOVERSION is not reported before Go 1.16
+	if len(lines) > 1 {
+		version = strings.TrimSpace(lines[1])
+	}
+
+	// moved from misc/wasm to lib/wasm in Go 1.24
+	for _, p := range []string{
+		filepath.Join(goroot, "lib", "wasm", "wasm_exec.js"),
+		filepath.Join(goroot, "misc", "wasm", "wasm_exec.js"),
+	} {
+		if _, err := os.Stat(p); err == nil {
+			return p, version, nil
+		}
+	}
+
+	return "", version, fmt.Errorf("wasm_exec.js not found in GOROOT %q", goroot)
+}
+
+// copyWasmExecJS makes sure dir contains the wasm_exec.js which matches the
+// active Go toolchain, replacing (and warning about) any other version found there.
+func copyWasmExecJS(dir string) error {
+
+	src, version, err := goToolchainWasmExecJS()
+	if err != nil {
+		return err
+	}
+	want, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	dst := filepath.Join(dir, "wasm_exec.js")
+	have, err := ioutil.ReadFile(dst)
+	if err == nil {
+		if bytes.Equal(have, want) {
+			return nil
+		}
+		log.Printf("WARNING: %s does not match the active Go toolchain (%s), replacing it with %s", dst, version, src)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if *flagV {
+		log.Printf("Copying %s to %s", src, dst)
+	}
+	return ioutil.WriteFile(dst, want, 0644)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyWasmExecJS(t *testing.T) {
+
+	tmpDir, err := ioutil.TempDir("", "TestCopyWasmExecJS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// a fake toolchain, go env reports whatever GOROOT says
+	goroot := filepath.Join(tmpDir, "goroot")
+	must(t, os.MkdirAll(goroot, 0755))
+	if prev, ok := os.LookupEnv("GOROOT"); ok {
+		defer os.Setenv("GOROOT", prev)
+	} else {
+		defer os.Unsetenv("GOROOT")
+	}
+	must(t, os.Setenv("GOROOT", goroot))
+
+	outDir := filepath.Join(tmpDir, "out")
+	must(t, os.MkdirAll(outDir, 0755))
+	dst := filepath.Join(outDir, "wasm_exec.js")
+
+	// neither location
+	if _, _, err := goToolchainWasmExecJS(); err == nil {
+		t.Errorf("expected error with no wasm_exec.js in GOROOT")
+	}
+	if err := copyWasmExecJS(outDir); err == nil {
+		t.Errorf("expected copy error with no wasm_exec.js in GOROOT")
+	}
+
+	// older toolchains have it in misc/wasm
+	misc := filepath.Join(goroot, "misc", "wasm", "wasm_exec.js")
+	must(t, os.MkdirAll(filepath.Dir(misc), 0755))
+	must(t, ioutil.WriteFile(misc, []byte("// misc\n"), 0644))
+	if p, _, err := goToolchainWasmExecJS(); err != nil || p != misc {
+		t.Errorf("got %q, %v; want %q", p, err, misc)
+	}
+	must(t, copyWasmExecJS(outDir))
+	if b, _ := ioutil.ReadFile(dst); string(b) != "// misc\n" {
+		t.Errorf("unexpected copy %q", b)
+	}
+
+	// Go 1.24 and later have it in lib/wasm, which wins, and the stale copy is replaced
+	lib := filepath.Join(goroot, "lib", "wasm", "wasm_exec.js")
+	must(t, os.MkdirAll(filepath.Dir(lib), 0755))
+	must(t, ioutil.WriteFile(lib, []byte("// lib\n"), 0644))
+	if p, _, err := goToolchainWasmExecJS(); err != nil || p != lib {
+		t.Errorf("got %q, %v; want %q", p, err, lib)
+	}
+	must(t, copyWasmExecJS(outDir))
+	if b, _ := ioutil.ReadFile(dst); string(b) != "// lib\n" {
+		t.Errorf("unexpected copy %q", b)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// frameRE matches the file and line of a frame in a Go stack trace, e.g.
+// "\t/home/me/app/client/main.go:12 +0x3".
+var frameRE = regexp.MustCompile(`^(\s+)(\S+\.go):(\d+)(.*)$`)
+
+// sourceResolver maps the file paths in Go stack traces to local source
+// files.  They're usually absolute paths on this machine already, but with
+// -trimpath they're module paths (with a version for dependencies) or, for
+// the standard library, relative to GOROOT/src.
+type sourceResolver struct {
+	once    sync.Once
+	goroot  string
+	modules [][2]string // path and dir of each module in the build list, longest path first
+}
+
+func (sr *sourceResolver) load() {
+	b, err := exec.Command("go", "env", "GOROOT").Output()
+	if err != nil {
+		log.Printf("Unable to find GOROOT for stack traces: %v", err)
+	}
+	sr.goroot = strings.TrimSpace(string(b))
+
+	b, err = exec.Command("go", "list", "-m", "-f", "{{.Path}}\t{{.Dir}}", "all").Output()
+	if err != nil {
+		if *flagV {
+			log.Printf("Unable to list modules for stack traces: %v", err)
+		}
+		return
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "\t", 2)
+		if len(parts) == 2 && parts[1] != "" {
+			sr.modules = append(sr.modules, [2]string{parts[0], parts[1]})
+		}
+	}
+	sort.SliceStable(sr.modules, func(i, j int) bool { return len(sr.modules[i][0]) > len(sr.modules[j][0]) })
+}
+
+// warm loads what resolve needs in the background, so that the first panic
+// to arrive doesn't wait on go list.
+func (sr *sourceResolver) warm() {
+	go sr.once.Do(sr.load)
+}
+
+// resolve returns the local path of file from a stack trace, relative to
+// the current directory where possible, or file unchanged if it can't be found.
+func (sr *sourceResolver) resolve(file string) string {
+	sr.once.Do(sr.load)
+
+	var cands []string
+	if f := filepath.FromSlash(file); filepath.IsAbs(f) {
+		cands = append(cands, f)
+	} else {
+		// e.g. github.com/a/b@v1.2.3/c.go
+		mp := file
+		if i := strings.Index(mp, "@"); i >= 0 {
+			if j := strings.Index(mp[i:], "/"); j >= 0 {
+				mp = mp[:i] + mp[i+j:]
+			}
+		}
+		for _, m := range sr.modules {
+			if strings.HasPrefix(mp, m[0]+"/") {
+				cands = append(cands, filepath.Join(m[1], filepath.FromSlash(mp[len(m[0]):])))
+			}
+		}
+		if sr.goroot != "" {
+			cands = append(cands, filepath.Join(sr.goroot, "src", f))
+		}
+	}
+
+	for _, c := range cands {
+		if _, err := os.Stat(c); err == nil {
+			if wd, err := os.Getwd(); err == nil {
+				if rel, err := filepath.Rel(wd, c); err == nil && !strings.HasPrefix(rel, "..") {
+					return rel
+				}
+			}
+			return c
+		}
+	}
+	return file
+}
+
+// symbolize rewrites the file of each frame in trace to its local path.
+func (sr *sourceResolver) symbolize(trace string) string {
+	lines := strings.Split(trace, "\n")
+	for i, l := range lines {
+		m := frameRE.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		lines[i] = m[1] + sr.resolve(m[2]) + ":" + m[3] + m[4]
+	}
+	return strings.Join(lines, "\n")
+}
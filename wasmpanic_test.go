@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSymbolize(t *testing.T) {
+
+	tmpDir, err := ioutil.TempDir("", "TestSymbolize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	must(t, os.MkdirAll(filepath.Join(tmpDir, "app", "client"), 0755))
+	must(t, os.MkdirAll(filepath.Join(tmpDir, "dep"), 0755))
+	must(t, ioutil.WriteFile(filepath.Join(tmpDir, "app", "client", "main.go"), nil, 0644))
+	must(t, ioutil.WriteFile(filepath.Join(tmpDir, "dep", "dep.go"), nil, 0644))
+
+	sr := &sourceResolver{modules: [][2]string{
+		{"example.com/app", filepath.Join(tmpDir, "app")},
+		{"example.com/dep", filepath.Join(tmpDir, "dep")},
+	}}
+	sr.once.Do(func() {}) // loaded above
+
+	trace := "panic: boom\n\ngoroutine 1 [running]:\n" +
+		"example.com/dep.F(...)\n\texample.com/dep@v1.2.0/dep.go:7\n" +
+		"main.main()\n\texample.com/app/client/main.go:9 +0x8\n" +
+		"main.other()\n\t/not/here/x.go:3 +0x1\n"
+	want := "panic: boom\n\ngoroutine 1 [running]:\n" +
+		"example.com/dep.F(...)\n\t" + filepath.Join(tmpDir, "dep", "dep.go") + ":7\n" +
+		"main.main()\n\t" + filepath.Join(tmpDir, "app", "client", "main.go") + ":9 +0x8\n" +
+		"main.other()\n\t/not/here/x.go:3 +0x1\n"
+	if got := sr.symbolize(trace); got != want {
+		t.Errorf("unexpected result:\n%s\nwant:\n%s", got, want)
+	}
+
+}